@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"net/http"
 
 	"github.com/alexliesenfeld/health"
@@ -9,17 +8,12 @@ import (
 
 const HealthAPIPath = "/health"
 
-func HandleHealthCheck() {
-	http.Handle(HealthAPIPath, healthCheckHandler())
+// HandleHealthCheck registers the health endpoint on mux, reporting the
+// result of the provided checks.
+func HandleHealthCheck(mux *http.ServeMux, opts ...health.CheckerOption) {
+	mux.Handle(HealthAPIPath, healthCheckHandler(opts...))
 }
 
-func healthCheckHandler() http.Handler {
-	return health.NewHandler(health.NewChecker(
-		health.WithCheck(health.Check{
-			Name: "signer-health",
-			Check: func(context.Context) error {
-				return nil
-			},
-		}),
-	))
+func healthCheckHandler(opts ...health.CheckerOption) http.Handler {
+	return health.NewHandler(health.NewChecker(opts...))
 }
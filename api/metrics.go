@@ -0,0 +1,16 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const MetricsAPIPath = "/metrics"
+
+// HandleMetrics registers the Prometheus metrics endpoint on mux, exposing the
+// metrics collected by gatherer.
+func HandleMetrics(mux *http.ServeMux, gatherer prometheus.Gatherer) {
+	mux.Handle(MetricsAPIPath, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
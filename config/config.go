@@ -2,43 +2,218 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/failover"
+	"github.com/ava-labs/cube-signer-sidecar/signerserver"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/ava-labs/cube-signer-sidecar/tracing"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 const (
-	defaultPort = 50051
+	defaultPort        = 50051
+	defaultHealthPort  = 8080
+	defaultMetricsPort = 9090
+
+	defaultListenHost = "127.0.0.1"
+	defaultSocketMode = "0600"
+
+	defaultTokenSecretKey = "token.json"
+
+	defaultShutdownTimeout = 30 * time.Second
+
+	defaultLogLevel  = "info"
+	defaultLogFormat = logging.AutoString
+
+	defaultTracingExporter   = "none"
+	defaultTracingSampleRate = 1.0
 )
 
 type Config struct {
-	TokenFilePath  string `mapstructure:"token-file-path" json:"token-file-path"`
-	KeyID          string `mapstructure:"key-id" json:"key-id"`
-	SignerEndpoint string `mapstructure:"signer-endpoint" json:"signer-endpoint"`
-	Port           uint16 `mapstructure:"port" json:"port"`
+	TokenFilePath string `mapstructure:"token-file-path" json:"token-file-path"`
+	KeyID         string `mapstructure:"key-id" json:"key-id"`
+	Port          uint16 `mapstructure:"port" json:"port"`
+	HealthPort    uint16 `mapstructure:"health-port" json:"health-port"`
+	MetricsPort   uint16 `mapstructure:"metrics-port" json:"metrics-port"`
+	LogLevel      string `mapstructure:"log-level" json:"log-level"`
+	LogFormat     string `mapstructure:"log-format" json:"log-format"`
+
+	// CubeSigner endpoints, in order of preference. Requests fail over to the
+	// next healthy endpoint when one is unreachable.
+	SignerEndpoints                []string      `mapstructure:"signer-endpoint" json:"signer-endpoint"`
+	SignerEndpointFailureThreshold int           `mapstructure:"signer-endpoint-failure-threshold" json:"signer-endpoint-failure-threshold"`
+	SignerEndpointCheckInterval    time.Duration `mapstructure:"signer-endpoint-check-interval" json:"signer-endpoint-check-interval"`
+
+	// Kubernetes Secret holding the token data, as an alternative to
+	// TokenFilePath
+	TokenSecret          string `mapstructure:"token-secret" json:"token-secret"`
+	TokenSecretNamespace string `mapstructure:"token-secret-namespace" json:"token-secret-namespace"`
+	TokenSecretKey       string `mapstructure:"token-secret-key" json:"token-secret-key"`
+
+	// Vault KV v2 secret holding the token data, as an alternative to
+	// TokenFilePath
+	TokenVaultPath    string        `mapstructure:"token-vault-path" json:"token-vault-path"`
+	VaultAddress      string        `mapstructure:"vault-address" json:"vault-address"`
+	VaultKVMount      string        `mapstructure:"vault-kv-mount" json:"vault-kv-mount"`
+	VaultToken        string        `mapstructure:"vault-token" json:"-"`
+	VaultRoleID       string        `mapstructure:"vault-role-id" json:"vault-role-id"`
+	VaultSecretID     string        `mapstructure:"vault-secret-id" json:"-"`
+	VaultAppRoleMount string        `mapstructure:"vault-approle-mount" json:"vault-approle-mount"`
+	VaultPollInterval time.Duration `mapstructure:"vault-poll-interval" json:"vault-poll-interval"`
+
+	// Where to read the key that token data is encrypted with at rest, one of
+	// env:NAME, file:PATH or fd:N. Token data is stored unencrypted if unset.
+	TokenEncryptionKey string `mapstructure:"token-encryption-key" json:"token-encryption-key"`
+
+	// Addresses to listen on, either host:port or unix:///path/to/socket.
+	// Takes precedence over Port.
+	ListenAddresses []string `mapstructure:"listen-address" json:"listen-address,omitempty"`
+	SocketMode      string   `mapstructure:"socket-mode" json:"socket-mode"`
+	SocketOwner     string   `mapstructure:"socket-owner" json:"socket-owner"`
+	// Allows listening on addresses reachable from other hosts
+	AllowExternalListen bool `mapstructure:"allow-external-listen" json:"allow-external-listen"`
+	// IP address the health and metrics endpoints listen on
+	HTTPHost string `mapstructure:"http-host" json:"http-host"`
+
+	// Keys to serve, as an alternative to key-id, token-file-path,
+	// token-secret, token-vault-path, port and listen-address
+	Keys []SignerKeyConfig `mapstructure:"keys" json:"keys,omitempty"`
+
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout" json:"shutdown-timeout"`
+
+	TokenRefreshMargin     float64       `mapstructure:"token-refresh-margin" json:"token-refresh-margin"`
+	TokenRefreshJitter     float64       `mapstructure:"token-refresh-jitter" json:"token-refresh-jitter"`
+	TokenRefreshMaxBackoff time.Duration `mapstructure:"token-refresh-max-backoff" json:"token-refresh-max-backoff"`
+	TokenExpiryWarning     time.Duration `mapstructure:"token-expiry-warning" json:"token-expiry-warning"`
+
+	UpstreamRetryMaxAttempts    int           `mapstructure:"upstream-retry-max-attempts" json:"upstream-retry-max-attempts"`
+	UpstreamRetryInitialBackoff time.Duration `mapstructure:"upstream-retry-initial-backoff" json:"upstream-retry-initial-backoff"`
+	UpstreamRetryMaxBackoff     time.Duration `mapstructure:"upstream-retry-max-backoff" json:"upstream-retry-max-backoff"`
+
+	CircuitBreakerErrorRate      float64       `mapstructure:"circuit-breaker-error-rate" json:"circuit-breaker-error-rate"`
+	CircuitBreakerMinRequests    int           `mapstructure:"circuit-breaker-min-requests" json:"circuit-breaker-min-requests"`
+	CircuitBreakerWindow         time.Duration `mapstructure:"circuit-breaker-window" json:"circuit-breaker-window"`
+	CircuitBreakerOpenDuration   time.Duration `mapstructure:"circuit-breaker-open-duration" json:"circuit-breaker-open-duration"`
+	CircuitBreakerHalfOpenProbes int           `mapstructure:"circuit-breaker-half-open-probes" json:"circuit-breaker-half-open-probes"`
+
+	UpstreamHedgePercentile float64       `mapstructure:"upstream-hedge-percentile" json:"upstream-hedge-percentile"`
+	UpstreamHedgeMinDelay   time.Duration `mapstructure:"upstream-hedge-min-delay" json:"upstream-hedge-min-delay"`
+	UpstreamHedgeMaxDelay   time.Duration `mapstructure:"upstream-hedge-max-delay" json:"upstream-hedge-max-delay"`
+
+	TLSCertFile     string `mapstructure:"tls-cert-file" json:"tls-cert-file"`
+	TLSKeyFile      string `mapstructure:"tls-key-file" json:"tls-key-file"`
+	TLSClientCAFile string `mapstructure:"tls-client-ca-file" json:"tls-client-ca-file"`
+
+	TracingExporter   string  `mapstructure:"tracing-exporter" json:"tracing-exporter"`
+	TracingEndpoint   string  `mapstructure:"tracing-endpoint" json:"tracing-endpoint"`
+	TracingInsecure   bool    `mapstructure:"tracing-insecure" json:"tracing-insecure"`
+	TracingSampleRate float64 `mapstructure:"tracing-sample-rate" json:"tracing-sample-rate"`
 }
 
 func (cfg *Config) Validate() error {
-	if cfg.TokenFilePath == "" {
-		return fmt.Errorf("token-file-path is required")
+	if err := cfg.validateHTTPHost(); err != nil {
+		return err
+	}
+
+	if err := cfg.validateSignerKeys(); err != nil {
+		return err
+	}
+
+	if err := cfg.validateSignerEndpoints(); err != nil {
+		return err
+	}
+
+	if cfg.MetricsPort == cfg.HealthPort {
+		return fmt.Errorf("metrics-port must differ from health-port")
+	}
+
+	if _, err := cfg.SocketOptions(); err != nil {
+		return err
+	}
+
+	if cfg.TokenEncryptionKey != "" {
+		if err := tokenstore.ValidateKeySource(cfg.TokenEncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("tls-cert-file and tls-key-file must be set together")
+	}
+
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return fmt.Errorf("tls-client-ca-file requires tls-cert-file and tls-key-file")
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown-timeout must be positive")
+	}
+
+	if err := cfg.RefreshConfig().Validate(); err != nil {
+		return fmt.Errorf("invalid token refresh configuration: %w", err)
+	}
+
+	if err := cfg.RetryConfig().Validate(); err != nil {
+		return fmt.Errorf("invalid upstream retry configuration: %w", err)
+	}
+
+	if err := cfg.BreakerConfig().Validate(); err != nil {
+		return fmt.Errorf("invalid circuit breaker configuration: %w", err)
+	}
+
+	if err := cfg.HedgeConfig().Validate(); err != nil {
+		return fmt.Errorf("invalid upstream hedging configuration: %w", err)
 	}
 
-	// Just check for existence and permissions of the file here
-	// Any other potential errors will be caught at time of usage
-	_, err := os.Stat(cfg.TokenFilePath)
-	if os.IsNotExist(err) || os.IsPermission(err) {
-		return fmt.Errorf("token-file-path cannot be accessed: %s", cfg.TokenFilePath)
+	if err := cfg.FailoverConfig().Validate(); err != nil {
+		return fmt.Errorf("invalid signer endpoint failover configuration: %w", err)
 	}
 
-	if cfg.KeyID == "" {
-		return fmt.Errorf("key-id is required")
+	if _, err := logging.ToLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("invalid log-level: %w", err)
 	}
 
-	if cfg.SignerEndpoint == "" {
+	if _, err := logging.ToFormat(cfg.LogFormat, os.Stdout.Fd()); err != nil {
+		return fmt.Errorf("invalid log-format: %w", err)
+	}
+
+	switch cfg.TracingExporter {
+	case "", tracing.ExporterNone, tracing.ExporterOTLPGRPC, tracing.ExporterOTLPHTTP:
+	default:
+		return fmt.Errorf("tracing-exporter must be one of %q, %q or %q", tracing.ExporterNone, tracing.ExporterOTLPGRPC, tracing.ExporterOTLPHTTP)
+	}
+
+	if cfg.TracingSampleRate < 0 || cfg.TracingSampleRate > 1 {
+		return fmt.Errorf("tracing-sample-rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func (cfg *Config) validateSignerEndpoints() error {
+	if len(cfg.SignerEndpoints) == 0 {
 		return fmt.Errorf("signer-endpoint is required")
 	}
+
+	seen := make(map[string]bool, len(cfg.SignerEndpoints))
+	for _, endpoint := range cfg.SignerEndpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid signer-endpoint %q: %w", endpoint, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid signer-endpoint %q: must be an http or https URL", endpoint)
+		}
+		if seen[endpoint] {
+			return fmt.Errorf("duplicate signer-endpoint %q", endpoint)
+		}
+		seen[endpoint] = true
+	}
 	return nil
 }
 
@@ -89,6 +264,35 @@ func BuildViper(fs *pflag.FlagSet) (*viper.Viper, error) {
 func BuildConfig(v *viper.Viper) (Config, error) {
 	// Set default values
 	v.SetDefault(PortKey, defaultPort)
+	v.SetDefault(HTTPHostKey, defaultListenHost)
+	v.SetDefault(HealthPortKey, defaultHealthPort)
+	v.SetDefault(MetricsPortKey, defaultMetricsPort)
+	v.SetDefault(SocketModeKey, defaultSocketMode)
+	v.SetDefault(TokenSecretKeyKey, defaultTokenSecretKey)
+	v.SetDefault(VaultKVMountKey, tokenstore.DefaultVaultKVMount)
+	v.SetDefault(VaultAppRoleMountKey, tokenstore.DefaultVaultAppRoleMount)
+	v.SetDefault(VaultPollIntervalKey, tokenstore.DefaultVaultPollInterval)
+	v.SetDefault(ShutdownTimeoutKey, defaultShutdownTimeout)
+	v.SetDefault(TokenRefreshMarginKey, signerserver.DefaultRefreshMargin)
+	v.SetDefault(TokenRefreshJitterKey, signerserver.DefaultRefreshJitter)
+	v.SetDefault(TokenRefreshMaxBackoffKey, signerserver.DefaultRefreshMaxBackoff)
+	v.SetDefault(TokenExpiryWarningKey, signerserver.DefaultRefreshExpiryWarning)
+	v.SetDefault(UpstreamRetryMaxAttemptsKey, signerserver.DefaultRetryMaxAttempts)
+	v.SetDefault(UpstreamRetryInitialBackoffKey, signerserver.DefaultRetryInitialBackoff)
+	v.SetDefault(UpstreamRetryMaxBackoffKey, signerserver.DefaultRetryMaxBackoff)
+	v.SetDefault(CircuitBreakerErrorRateKey, signerserver.DefaultBreakerErrorRate)
+	v.SetDefault(CircuitBreakerMinRequestsKey, signerserver.DefaultBreakerMinRequests)
+	v.SetDefault(CircuitBreakerWindowKey, signerserver.DefaultBreakerWindow)
+	v.SetDefault(CircuitBreakerOpenDurationKey, signerserver.DefaultBreakerOpenDuration)
+	v.SetDefault(CircuitBreakerHalfOpenProbesKey, signerserver.DefaultBreakerHalfOpenProbes)
+	v.SetDefault(UpstreamHedgeMinDelayKey, signerserver.DefaultHedgeMinDelay)
+	v.SetDefault(UpstreamHedgeMaxDelayKey, signerserver.DefaultHedgeMaxDelay)
+	v.SetDefault(EndpointFailureThresholdKey, failover.DefaultFailureThreshold)
+	v.SetDefault(EndpointCheckIntervalKey, failover.DefaultCheckInterval)
+	v.SetDefault(LogLevelKey, defaultLogLevel)
+	v.SetDefault(LogFormatKey, defaultLogFormat)
+	v.SetDefault(TracingExporterKey, defaultTracingExporter)
+	v.SetDefault(TracingSampleRateKey, defaultTracingSampleRate)
 
 	// Build the config from Viper
 	var cfg Config
@@ -99,3 +303,67 @@ func BuildConfig(v *viper.Viper) (Config, error) {
 
 	return cfg, nil
 }
+
+// TracingConfig returns the configuration of the tracing exporter.
+func (cfg *Config) TracingConfig() tracing.Config {
+	return tracing.Config{
+		Exporter:   cfg.TracingExporter,
+		Endpoint:   cfg.TracingEndpoint,
+		Insecure:   cfg.TracingInsecure,
+		SampleRate: cfg.TracingSampleRate,
+	}
+}
+
+// RefreshConfig returns the configuration of the background token refresh.
+func (cfg *Config) RefreshConfig() signerserver.RefreshConfig {
+	return signerserver.RefreshConfig{
+		Margin:        cfg.TokenRefreshMargin,
+		Jitter:        cfg.TokenRefreshJitter,
+		MaxBackoff:    cfg.TokenRefreshMaxBackoff,
+		ExpiryWarning: cfg.TokenExpiryWarning,
+	}
+}
+
+// RetryConfig returns the configuration of retries of CubeSigner requests.
+func (cfg *Config) RetryConfig() signerserver.RetryConfig {
+	return signerserver.RetryConfig{
+		MaxAttempts:    cfg.UpstreamRetryMaxAttempts,
+		InitialBackoff: cfg.UpstreamRetryInitialBackoff,
+		MaxBackoff:     cfg.UpstreamRetryMaxBackoff,
+	}
+}
+
+// BreakerConfig returns the configuration of the circuit breaker around
+// CubeSigner requests.
+func (cfg *Config) BreakerConfig() signerserver.BreakerConfig {
+	return signerserver.BreakerConfig{
+		ErrorRate:      cfg.CircuitBreakerErrorRate,
+		MinRequests:    cfg.CircuitBreakerMinRequests,
+		Window:         cfg.CircuitBreakerWindow,
+		OpenDuration:   cfg.CircuitBreakerOpenDuration,
+		HalfOpenProbes: cfg.CircuitBreakerHalfOpenProbes,
+	}
+}
+
+// HedgeConfig returns the configuration of hedged CubeSigner signing requests.
+func (cfg *Config) HedgeConfig() signerserver.HedgeConfig {
+	return signerserver.HedgeConfig{
+		Percentile: cfg.UpstreamHedgePercentile,
+		MinDelay:   cfg.UpstreamHedgeMinDelay,
+		MaxDelay:   cfg.UpstreamHedgeMaxDelay,
+	}
+}
+
+// FailoverConfig returns the configuration of the failover across the signer
+// endpoints.
+func (cfg *Config) FailoverConfig() failover.Config {
+	return failover.Config{
+		FailureThreshold: cfg.SignerEndpointFailureThreshold,
+		CheckInterval:    cfg.SignerEndpointCheckInterval,
+	}
+}
+
+// TLSEnabled returns true if the signer gRPC server should serve TLS.
+func (cfg *Config) TLSEnabled() bool {
+	return cfg.TLSCertFile != ""
+}
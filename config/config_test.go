@@ -0,0 +1,413 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ava-labs/cube-signer-sidecar/failover"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name string, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func buildConfig(t *testing.T, configJSON string) (Config, error) {
+	t.Helper()
+	fs := BuildFlagSet()
+	require.NoError(t, fs.Parse([]string{"--" + ConfigFileKey, writeFile(t, "config.json", configJSON)}))
+
+	v, err := BuildViper(fs)
+	require.NoError(t, err)
+	return NewConfig(v)
+}
+
+func TestSignerKeys(t *testing.T) {
+	tokenA := writeFile(t, "a.json", "{}")
+	tokenB := writeFile(t, "b.json", "{}")
+
+	tests := []struct {
+		name       string
+		configJSON string
+		expected   []SignerKeyConfig
+		err        string
+	}{
+		{
+			name: "single key",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `"
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, Port: defaultPort, ListenAddresses: []string{}},
+			},
+		},
+		{
+			name: "multiple keys",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "port": 50051},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "port": 50052}
+				]
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, Port: 50051},
+				{KeyID: "key-b", TokenFilePath: tokenB, Port: 50052},
+			},
+		},
+		{
+			name: "shared token file",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "port": 50051},
+					{"key-id": "key-b", "token-file-path": "` + tokenA + `", "port": 50052}
+				]
+			}`,
+			err: "used by more than one key",
+		},
+		{
+			name: "token secrets",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-secret": "signer-token-a", "port": 50051},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "port": 50052}
+				]
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenSecret: "signer-token-a", Port: 50051},
+				{KeyID: "key-b", TokenFilePath: tokenB, Port: 50052},
+			},
+		},
+		{
+			name: "shared token secret",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-secret": "signer-token", "port": 50051},
+					{"key-id": "key-b", "token-secret": "signer-token", "port": 50052}
+				]
+			}`,
+			err: "used by more than one key",
+		},
+		{
+			name: "token file and secret",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"token-secret": "signer-token"
+			}`,
+			err: "only one of token-file-path, token-secret and token-vault-path",
+		},
+		{
+			name: "no token store",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a"
+			}`,
+			err: "token-file-path, token-secret or token-vault-path is required",
+		},
+		{
+			name: "token vault paths",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"vault-address": "https://vault.example.com:8200",
+				"vault-role-id": "role-id",
+				"vault-secret-id": "secret-id",
+				"keys": [
+					{"key-id": "key-a", "token-vault-path": "cube-signer/key-a", "port": 50051},
+					{"key-id": "key-b", "token-vault-path": "cube-signer/key-b", "port": 50052}
+				]
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenVaultPath: "cube-signer/key-a", Port: 50051},
+				{KeyID: "key-b", TokenVaultPath: "cube-signer/key-b", Port: 50052},
+			},
+		},
+		{
+			name: "token vault path without auth",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"vault-address": "https://vault.example.com:8200",
+				"key-id": "key-a",
+				"token-vault-path": "cube-signer/key-a"
+			}`,
+			err: "invalid Vault configuration for key key-a",
+		},
+		{
+			name: "invalid token encryption key",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"token-encryption-key": "kms:token-key"
+			}`,
+			err: "invalid token encryption key source",
+		},
+		{
+			name: "duplicate port",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "port": 50051},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "port": 50051}
+				]
+			}`,
+			err: "already used",
+		},
+		{
+			name: "port used by health server",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "port": 8080}
+				]
+			}`,
+			err: "already used by health-port",
+		},
+		{
+			name: "listen addresses",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "listen-address": ["127.0.0.1:50051", "unix:///run/signer/a.sock"]},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "listen-address": ["127.0.0.2:50051"]}
+				]
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, ListenAddresses: []string{"127.0.0.1:50051", "unix:///run/signer/a.sock"}},
+				{KeyID: "key-b", TokenFilePath: tokenB, ListenAddresses: []string{"127.0.0.2:50051"}},
+			},
+		},
+		{
+			name: "duplicate socket",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "listen-address": ["unix:///run/signer.sock"]},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "listen-address": ["unix:///run/signer.sock"]}
+				]
+			}`,
+			err: "already used by key key-a",
+		},
+		{
+			name: "address overlapping all interfaces",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"keys": [
+					{"key-id": "key-a", "token-file-path": "` + tokenA + `", "port": 50051},
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "listen-address": ["127.0.0.1:50051"]}
+				]
+			}`,
+			err: "already used by key key-a",
+		},
+		{
+			name: "ipv6 loopback",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": ["[::1]:50051"]
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, Port: defaultPort, ListenAddresses: []string{"[::1]:50051"}},
+			},
+		},
+		{
+			name: "all interfaces",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": [":50051"]
+			}`,
+			err: "reachable from other hosts",
+		},
+		{
+			name: "external address",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": ["10.0.0.1:50051"]
+			}`,
+			err: "reachable from other hosts",
+		},
+		{
+			name: "external address allowed",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": ["10.0.0.1:50051", "[2001:db8::1]:50051"],
+				"allow-external-listen": true
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, Port: defaultPort, ListenAddresses: []string{"10.0.0.1:50051", "[2001:db8::1]:50051"}},
+			},
+		},
+		{
+			name: "external http host",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"http-host": "0.0.0.0"
+			}`,
+			err: "http-host 0.0.0.0 is reachable from other hosts",
+		},
+		{
+			name: "external http host allowed",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"http-host": "0.0.0.0",
+				"allow-external-listen": true
+			}`,
+			expected: []SignerKeyConfig{
+				{KeyID: "key-a", TokenFilePath: tokenA, Port: defaultPort, ListenAddresses: []string{}},
+			},
+		},
+		{
+			name: "http host name",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"http-host": "localhost"
+			}`,
+			err: "invalid http-host",
+		},
+		{
+			name: "hostname",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": ["localhost:50051"]
+			}`,
+			err: "must be an IPv4 or IPv6 address",
+		},
+		{
+			name: "relative socket path",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"listen-address": ["unix://signer.sock"]
+			}`,
+			err: "must be absolute",
+		},
+		{
+			name: "invalid socket mode",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"token-file-path": "` + tokenA + `",
+				"socket-mode": "rw-rw----"
+			}`,
+			err: "invalid socket mode",
+		},
+		{
+			name: "key-id and keys",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"key-id": "key-a",
+				"keys": [
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "port": 50052}
+				]
+			}`,
+			err: "cannot be used together",
+		},
+		{
+			name: "token-file-path and keys",
+			configJSON: `{
+				"signer-endpoint": "https://example.com",
+				"token-file-path": "` + tokenA + `",
+				"keys": [
+					{"key-id": "key-b", "token-file-path": "` + tokenB + `", "port": 50052}
+				]
+			}`,
+			err: "token-file-path, token-secret and token-vault-path cannot be used together with keys",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			cfg, err := buildConfig(t, tt.configJSON)
+			if tt.err != "" {
+				require.ErrorContains(err, tt.err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.expected, cfg.SignerKeys())
+		})
+	}
+}
+
+func TestSignerEndpoints(t *testing.T) {
+	token := writeFile(t, "token.json", "{}")
+
+	tests := []struct {
+		name      string
+		endpoints string
+		expected  []string
+		err       string
+	}{
+		{
+			name:      "single endpoint",
+			endpoints: `"https://example.com"`,
+			expected:  []string{"https://example.com"},
+		},
+		{
+			name:      "multiple endpoints",
+			endpoints: `["https://a.example.com", "https://b.example.com"]`,
+			expected:  []string{"https://a.example.com", "https://b.example.com"},
+		},
+		{
+			name:      "no endpoints",
+			endpoints: `[]`,
+			err:       "signer-endpoint is required",
+		},
+		{
+			name:      "duplicate endpoint",
+			endpoints: `["https://a.example.com", "https://a.example.com"]`,
+			err:       "duplicate signer-endpoint",
+		},
+		{
+			name:      "not a URL",
+			endpoints: `["a.example.com"]`,
+			err:       "must be an http or https URL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			cfg, err := buildConfig(t, `{
+				"signer-endpoint": `+tt.endpoints+`,
+				"key-id": "key-a",
+				"token-file-path": "`+token+`"
+			}`)
+			if tt.err != "" {
+				require.ErrorContains(err, tt.err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.expected, cfg.SignerEndpoints)
+			require.Equal(failover.DefaultConfig(), cfg.FailoverConfig())
+		})
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/failover"
+	"github.com/ava-labs/cube-signer-sidecar/signerserver"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
 	"github.com/spf13/pflag"
 )
 
@@ -17,6 +21,66 @@ const (
 	KeyIDKey         = "key-id"
 	EndpointKey      = "signer-endpoint"
 	PortKey          = "port"
+	HealthPortKey    = "health-port"
+	MetricsPortKey   = "metrics-port"
+	LogLevelKey      = "log-level"
+	LogFormatKey     = "log-format"
+
+	TokenSecretKey          = "token-secret"
+	TokenSecretNamespaceKey = "token-secret-namespace"
+	TokenSecretKeyKey       = "token-secret-key"
+
+	TokenVaultPathKey    = "token-vault-path"
+	VaultAddressKey      = "vault-address"
+	VaultKVMountKey      = "vault-kv-mount"
+	VaultTokenKey        = "vault-token"
+	VaultRoleIDKey       = "vault-role-id"
+	VaultSecretIDKey     = "vault-secret-id"
+	VaultAppRoleMountKey = "vault-approle-mount"
+	VaultPollIntervalKey = "vault-poll-interval"
+
+	TokenEncryptionKeyKey = "token-encryption-key"
+
+	ListenAddressKey = "listen-address"
+	SocketModeKey    = "socket-mode"
+	SocketOwnerKey   = "socket-owner"
+
+	AllowExternalListenKey = "allow-external-listen"
+
+	HTTPHostKey = "http-host"
+
+	ShutdownTimeoutKey = "shutdown-timeout"
+
+	TokenRefreshMarginKey     = "token-refresh-margin"
+	TokenRefreshJitterKey     = "token-refresh-jitter"
+	TokenRefreshMaxBackoffKey = "token-refresh-max-backoff"
+	TokenExpiryWarningKey     = "token-expiry-warning"
+
+	UpstreamRetryMaxAttemptsKey    = "upstream-retry-max-attempts"
+	UpstreamRetryInitialBackoffKey = "upstream-retry-initial-backoff"
+	UpstreamRetryMaxBackoffKey     = "upstream-retry-max-backoff"
+
+	CircuitBreakerErrorRateKey      = "circuit-breaker-error-rate"
+	CircuitBreakerMinRequestsKey    = "circuit-breaker-min-requests"
+	CircuitBreakerWindowKey         = "circuit-breaker-window"
+	CircuitBreakerOpenDurationKey   = "circuit-breaker-open-duration"
+	CircuitBreakerHalfOpenProbesKey = "circuit-breaker-half-open-probes"
+
+	UpstreamHedgePercentileKey = "upstream-hedge-percentile"
+	UpstreamHedgeMinDelayKey   = "upstream-hedge-min-delay"
+	UpstreamHedgeMaxDelayKey   = "upstream-hedge-max-delay"
+
+	EndpointFailureThresholdKey = "signer-endpoint-failure-threshold"
+	EndpointCheckIntervalKey    = "signer-endpoint-check-interval"
+
+	TLSCertFileKey     = "tls-cert-file"
+	TLSKeyFileKey      = "tls-key-file"
+	TLSClientCAFileKey = "tls-client-ca-file"
+
+	TracingExporterKey   = "tracing-exporter"
+	TracingEndpointKey   = "tracing-endpoint"
+	TracingInsecureKey   = "tracing-insecure"
+	TracingSampleRateKey = "tracing-sample-rate"
 )
 
 func BuildFlagSet() *pflag.FlagSet {
@@ -25,9 +89,62 @@ func BuildFlagSet() *pflag.FlagSet {
 	fs.String(ConfigFileKey, "", "Path to the config file")
 
 	fs.String(TokenFilePathKey, "", "Path to the token file")
+	fs.String(TokenSecretKey, "", "Name of the Kubernetes Secret holding the token data, as an alternative to token-file-path")
+	fs.String(TokenSecretNamespaceKey, "", "Namespace of the token Secrets, defaults to the namespace of the pod")
+	fs.String(TokenSecretKeyKey, defaultTokenSecretKey, "Key of the token data in the token Secrets")
+	fs.String(TokenVaultPathKey, "", "Path of the Vault KV v2 secret holding the token data, as an alternative to token-file-path")
+	fs.String(VaultAddressKey, "", "Address of the Vault server")
+	fs.String(VaultKVMountKey, tokenstore.DefaultVaultKVMount, "Mount path of the Vault KV v2 secrets engine")
+	fs.String(VaultTokenKey, "", "Vault token")
+	fs.String(VaultRoleIDKey, "", "Vault AppRole role ID, as an alternative to vault-token")
+	fs.String(VaultSecretIDKey, "", "Vault AppRole secret ID")
+	fs.String(VaultAppRoleMountKey, tokenstore.DefaultVaultAppRoleMount, "Mount path of the Vault AppRole auth method")
+	fs.Duration(VaultPollIntervalKey, tokenstore.DefaultVaultPollInterval, "How often the Vault secrets are checked for new sessions")
+	fs.String(TokenEncryptionKeyKey, "", "Where to read the key to encrypt token data at rest with, one of env:NAME, file:PATH or fd:N")
 	fs.String(KeyIDKey, "", "Key ID")
-	fs.String(EndpointKey, "", "Signer endpoint")
-	fs.Uint16(PortKey, defaultPort, "Port to listen on")
+	fs.StringSlice(EndpointKey, nil, "Signer endpoints, in order of preference. Requests fail over to the next healthy endpoint")
+	fs.Uint16(PortKey, defaultPort, "Port to listen on, on the loopback interface")
+	fs.StringSlice(ListenAddressKey, nil, "Addresses to listen on, either host:port or unix:///path/to/socket. Takes precedence over port")
+	fs.String(SocketModeKey, defaultSocketMode, "File mode of unix socket listeners")
+	fs.String(SocketOwnerKey, "", "Owner of unix socket listeners, in the form user[:group]")
+	fs.Bool(AllowExternalListenKey, false, "Allow listen addresses that are reachable from other hosts")
+	fs.String(HTTPHostKey, defaultListenHost, "IP address to serve the HTTP health and metrics endpoints on")
+	fs.Uint16(HealthPortKey, defaultHealthPort, "Port to serve the HTTP health endpoint on")
+	fs.Uint16(MetricsPortKey, defaultMetricsPort, "Port to serve the Prometheus metrics endpoint on")
+	fs.String(LogLevelKey, defaultLogLevel, "Log level, one of verbo, debug, trace, info, warn, error, fatal or off")
+	fs.String(LogFormatKey, defaultLogFormat, logging.FormatDescription)
+	fs.Duration(ShutdownTimeoutKey, defaultShutdownTimeout, "Time to wait for in-flight requests to finish on shutdown")
+
+	fs.Float64(TokenRefreshMarginKey, signerserver.DefaultRefreshMargin, "Fraction of the session token's lifetime left when it is refreshed")
+	fs.Float64(TokenRefreshJitterKey, signerserver.DefaultRefreshJitter, "Maximum fraction of the session token's lifetime the refresh is randomly brought forward by")
+	fs.Duration(TokenRefreshMaxBackoffKey, signerserver.DefaultRefreshMaxBackoff, "Maximum wait between failed session token refreshes")
+	fs.Duration(TokenExpiryWarningKey, signerserver.DefaultRefreshExpiryWarning, "Time before the refresh token expires from which the sidecar reports itself as unhealthy")
+
+	fs.Int(UpstreamRetryMaxAttemptsKey, signerserver.DefaultRetryMaxAttempts, "Number of times a CubeSigner request that fails transiently is sent, 1 disables retries")
+	fs.Duration(UpstreamRetryInitialBackoffKey, signerserver.DefaultRetryInitialBackoff, "Wait before the first retry of a CubeSigner request")
+	fs.Duration(UpstreamRetryMaxBackoffKey, signerserver.DefaultRetryMaxBackoff, "Maximum wait between retries of a CubeSigner request")
+
+	fs.Float64(CircuitBreakerErrorRateKey, signerserver.DefaultBreakerErrorRate, "Fraction of failed CubeSigner requests that opens the circuit breaker, 0 disables it")
+	fs.Int(CircuitBreakerMinRequestsKey, signerserver.DefaultBreakerMinRequests, "Number of CubeSigner requests in the window below which the circuit breaker doesn't open")
+	fs.Duration(CircuitBreakerWindowKey, signerserver.DefaultBreakerWindow, "How far back CubeSigner requests count towards the circuit breaker error rate")
+	fs.Duration(CircuitBreakerOpenDurationKey, signerserver.DefaultBreakerOpenDuration, "How long the circuit breaker stays open before probing CubeSigner")
+	fs.Int(CircuitBreakerHalfOpenProbesKey, signerserver.DefaultBreakerHalfOpenProbes, "Number of probe requests that must succeed to close the circuit breaker")
+
+	fs.Float64(UpstreamHedgePercentileKey, 0, "Percentile of recent CubeSigner signing latencies after which a slow request is hedged with a second one, 0 disables hedging")
+	fs.Duration(UpstreamHedgeMinDelayKey, signerserver.DefaultHedgeMinDelay, "Shortest wait before hedging a CubeSigner signing request")
+	fs.Duration(UpstreamHedgeMaxDelayKey, signerserver.DefaultHedgeMaxDelay, "Longest wait before hedging a CubeSigner signing request")
+
+	fs.Int(EndpointFailureThresholdKey, failover.DefaultFailureThreshold, "Number of consecutive failed requests after which a signer endpoint is unhealthy")
+	fs.Duration(EndpointCheckIntervalKey, failover.DefaultCheckInterval, "How often the health of every signer endpoint is checked")
+
+	fs.String(TLSCertFileKey, "", "Path to the TLS certificate of the signer server")
+	fs.String(TLSKeyFileKey, "", "Path to the TLS private key of the signer server")
+	fs.String(TLSClientCAFileKey, "", "Path to the CA certificates used to verify client certificates")
+
+	fs.String(TracingExporterKey, defaultTracingExporter, "Tracing exporter to use, one of none, otlp-grpc or otlp-http")
+	fs.String(TracingEndpointKey, "", "Endpoint of the OTLP collector")
+	fs.Bool(TracingInsecureKey, false, "Disable TLS when connecting to the OTLP collector")
+	fs.Float64(TracingSampleRateKey, defaultTracingSampleRate, "Fraction of traces to sample")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/listener"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+)
+
+// SignerKeyConfig configures a single key served by the sidecar. Each key is
+// served on its own listeners, with its own CubeSigner session.
+type SignerKeyConfig struct {
+	KeyID         string `mapstructure:"key-id" json:"key-id"`
+	TokenFilePath string `mapstructure:"token-file-path" json:"token-file-path"`
+	// Kubernetes Secret holding the token data, as an alternative to
+	// TokenFilePath
+	TokenSecret string `mapstructure:"token-secret" json:"token-secret,omitempty"`
+	// Path of the Vault KV v2 secret holding the token data, as an
+	// alternative to TokenFilePath
+	TokenVaultPath string `mapstructure:"token-vault-path" json:"token-vault-path,omitempty"`
+	Port           uint16 `mapstructure:"port" json:"port"`
+	// Addresses to listen on, either host:port or unix:///path/to/socket.
+	// Takes precedence over Port.
+	ListenAddresses []string `mapstructure:"listen-address" json:"listen-address,omitempty"`
+}
+
+// Addresses returns the addresses the key is served on. If no listen
+// addresses are configured, the key is served on Port on the loopback
+// interface.
+func (k SignerKeyConfig) Addresses() ([]listener.Address, error) {
+	if len(k.ListenAddresses) == 0 {
+		return []listener.Address{tcpAddress(defaultListenHost, k.Port)}, nil
+	}
+
+	addrs := make([]listener.Address, len(k.ListenAddresses))
+	for i, addr := range k.ListenAddresses {
+		parsed, err := listener.ParseAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = parsed
+	}
+	return addrs, nil
+}
+
+// SignerKeys returns the keys to serve. If no keys are configured, the
+// top level key-id, token-file-path, token-secret, token-vault-path, port and
+// listen-address are served as a single key.
+func (cfg *Config) SignerKeys() []SignerKeyConfig {
+	if len(cfg.Keys) == 0 {
+		return []SignerKeyConfig{{
+			KeyID:           cfg.KeyID,
+			TokenFilePath:   cfg.TokenFilePath,
+			TokenSecret:     cfg.TokenSecret,
+			TokenVaultPath:  cfg.TokenVaultPath,
+			Port:            cfg.Port,
+			ListenAddresses: cfg.ListenAddresses,
+		}}
+	}
+	return cfg.Keys
+}
+
+// TokenStore returns the store holding the token data of key. If
+// encryptionKey is set, the token data is encrypted at rest with it.
+func (cfg *Config) TokenStore(key SignerKeyConfig, encryptionKey []byte, log logging.Logger) (tokenstore.TokenStore, error) {
+	var (
+		store tokenstore.TokenStore
+		err   error
+	)
+	switch {
+	case key.TokenSecret != "":
+		store, err = tokenstore.NewKubernetesSecret(cfg.TokenSecretNamespace, key.TokenSecret, cfg.TokenSecretKey, log)
+	case key.TokenVaultPath != "":
+		store, err = tokenstore.NewVault(cfg.VaultConfig(key.TokenVaultPath), log)
+	default:
+		store = tokenstore.NewFile(key.TokenFilePath, log)
+	}
+	if err != nil || encryptionKey == nil {
+		return store, err
+	}
+	return tokenstore.NewEncrypted(store, encryptionKey, log)
+}
+
+// ReadTokenEncryptionKey returns the key to encrypt token data with, or nil
+// if token data isn't encrypted.
+func (cfg *Config) ReadTokenEncryptionKey() ([]byte, error) {
+	if cfg.TokenEncryptionKey == "" {
+		return nil, nil
+	}
+	return tokenstore.ReadKey(cfg.TokenEncryptionKey)
+}
+
+// VaultConfig returns the configuration of the Vault token store for the
+// secret at path.
+func (cfg *Config) VaultConfig(path string) tokenstore.VaultConfig {
+	return tokenstore.VaultConfig{
+		Address:      cfg.VaultAddress,
+		KVMount:      cfg.VaultKVMount,
+		Path:         path,
+		Token:        cfg.VaultToken,
+		RoleID:       cfg.VaultRoleID,
+		SecretID:     cfg.VaultSecretID,
+		AppRoleMount: cfg.VaultAppRoleMount,
+		PollInterval: cfg.VaultPollInterval,
+	}
+}
+
+// SocketOptions returns the permissions of unix socket listeners.
+func (cfg *Config) SocketOptions() (listener.SocketOptions, error) {
+	mode, err := listener.ParseSocketMode(cfg.SocketMode)
+	if err != nil {
+		return listener.SocketOptions{}, err
+	}
+
+	uid, gid, err := listener.ParseSocketOwner(cfg.SocketOwner)
+	if err != nil {
+		return listener.SocketOptions{}, err
+	}
+
+	return listener.SocketOptions{
+		Mode: mode,
+		UID:  uid,
+		GID:  gid,
+	}, nil
+}
+
+// HTTPAddress returns the address the HTTP endpoint on port listens on.
+func (cfg *Config) HTTPAddress(port uint16) listener.Address {
+	return tcpAddress(cfg.HTTPHost, port)
+}
+
+func (cfg *Config) validateHTTPHost() error {
+	if _, err := netip.ParseAddr(cfg.HTTPHost); err != nil {
+		return fmt.Errorf("invalid http-host %q: must be an IPv4 or IPv6 address", cfg.HTTPHost)
+	}
+	// The health checks and metrics reveal the state of the sessions
+	if addr := cfg.HTTPAddress(cfg.HealthPort); !addr.IsLocal() && !cfg.AllowExternalListen {
+		return fmt.Errorf("http-host %s is reachable from other hosts, set %s to allow it", cfg.HTTPHost, AllowExternalListenKey)
+	}
+	return nil
+}
+
+func (cfg *Config) validateSignerKeys() error {
+	if len(cfg.Keys) != 0 && (cfg.KeyID != "" || len(cfg.ListenAddresses) != 0) {
+		return fmt.Errorf("key-id and listen-address cannot be used together with keys")
+	}
+	// Each key has its own token store
+	if len(cfg.Keys) != 0 && (cfg.TokenFilePath != "" || cfg.TokenSecret != "" || cfg.TokenVaultPath != "") {
+		return fmt.Errorf("token-file-path, token-secret and token-vault-path cannot be used together with keys")
+	}
+
+	var (
+		keyIDs       = make(map[string]bool)
+		tokenFiles   = make(map[string]bool)
+		tokenSecrets = make(map[string]bool)
+		vaultPaths   = make(map[string]bool)
+		listeners    = []listenerOwner{
+			{addr: cfg.HTTPAddress(cfg.HealthPort), owner: HealthPortKey},
+			{addr: cfg.HTTPAddress(cfg.MetricsPort), owner: MetricsPortKey},
+		}
+	)
+	for _, key := range cfg.SignerKeys() {
+		if key.KeyID == "" {
+			return fmt.Errorf("key-id is required")
+		}
+		if keyIDs[key.KeyID] {
+			return fmt.Errorf("key %s is configured more than once", key.KeyID)
+		}
+		keyIDs[key.KeyID] = true
+
+		switch key.numTokenStores() {
+		case 0:
+			return fmt.Errorf("token-file-path, token-secret or token-vault-path is required for key %s", key.KeyID)
+		case 1:
+		default:
+			return fmt.Errorf("only one of token-file-path, token-secret and token-vault-path can be used for key %s", key.KeyID)
+		}
+
+		switch {
+		case key.TokenVaultPath != "":
+			if err := cfg.VaultConfig(key.TokenVaultPath).Validate(); err != nil {
+				return fmt.Errorf("invalid Vault configuration for key %s: %w", key.KeyID, err)
+			}
+			if vaultPaths[key.TokenVaultPath] {
+				return fmt.Errorf("token-vault-path %s is used by more than one key", key.TokenVaultPath)
+			}
+			vaultPaths[key.TokenVaultPath] = true
+		case key.TokenSecret != "":
+			// Sessions are refreshed independently, so they can't share a
+			// Secret
+			if tokenSecrets[key.TokenSecret] {
+				return fmt.Errorf("token-secret %s is used by more than one key", key.TokenSecret)
+			}
+			tokenSecrets[key.TokenSecret] = true
+		default:
+			// Just check for existence and permissions of the file here
+			// Any other potential errors will be caught at time of usage
+			_, err := os.Stat(key.TokenFilePath)
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return fmt.Errorf("token-file-path cannot be accessed: %s", key.TokenFilePath)
+			}
+
+			// Sessions are refreshed independently, so they can't share a file
+			if tokenFiles[key.TokenFilePath] {
+				return fmt.Errorf("token-file-path %s is used by more than one key", key.TokenFilePath)
+			}
+			tokenFiles[key.TokenFilePath] = true
+		}
+
+		if len(key.ListenAddresses) == 0 && key.Port == 0 {
+			return fmt.Errorf("port or listen-address is required for key %s", key.KeyID)
+		}
+
+		addrs, err := key.Addresses()
+		if err != nil {
+			return fmt.Errorf("invalid listen-address for key %s: %w", key.KeyID, err)
+		}
+		for _, addr := range addrs {
+			// Anyone who can reach the signer can sign with the key
+			if !addr.IsLocal() && !cfg.AllowExternalListen {
+				return fmt.Errorf(
+					"address %s of key %s is reachable from other hosts, set %s to allow it",
+					addr, key.KeyID, AllowExternalListenKey,
+				)
+			}
+			for _, other := range listeners {
+				if conflicts(addr, other.addr) {
+					return fmt.Errorf("address %s of key %s is already used by %s", addr, key.KeyID, other.owner)
+				}
+			}
+			listeners = append(listeners, listenerOwner{addr: addr, owner: "key " + key.KeyID})
+		}
+	}
+	return nil
+}
+
+func (k SignerKeyConfig) numTokenStores() int {
+	n := 0
+	for _, store := range []string{k.TokenFilePath, k.TokenSecret, k.TokenVaultPath} {
+		if store != "" {
+			n++
+		}
+	}
+	return n
+}
+
+type listenerOwner struct {
+	addr  listener.Address
+	owner string
+}
+
+func tcpAddress(host string, port uint16) listener.Address {
+	return listener.Address{
+		Network: listener.NetworkTCP,
+		Address: net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}
+}
+
+// conflicts returns true if a and b can't be listened on at the same time.
+func conflicts(a, b listener.Address) bool {
+	if a.Network != b.Network {
+		return false
+	}
+	if a.Network == listener.NetworkUnix {
+		return a.Address == b.Address
+	}
+
+	hostA, portA, errA := net.SplitHostPort(a.Address)
+	hostB, portB, errB := net.SplitHostPort(b.Address)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	return hostA == hostB || isUnspecified(hostA) || isUnspecified(hostB)
+}
+
+func isUnspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsUnspecified()
+}
@@ -0,0 +1,348 @@
+// Package failover spreads CubeSigner API requests over an ordered list of
+// endpoints serving the same organization, failing over to the next healthy
+// endpoint when one is unreachable.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alexliesenfeld/health"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultCheckInterval    = 10 * time.Second
+
+	metricsNamespace = "cube_signer_sidecar"
+)
+
+type hedgeKey struct{}
+
+var (
+	_ api.ClientInterface = (*Client)(nil)
+
+	errNoEndpoints = errors.New("at least one endpoint is required")
+)
+
+// Config configures how endpoint health is tracked.
+type Config struct {
+	// FailureThreshold is the number of consecutive failed requests after
+	// which an endpoint is considered unhealthy.
+	FailureThreshold int
+	// CheckInterval is how often every endpoint is checked, so that unhealthy
+	// endpoints are used again once they recover.
+	CheckInterval time.Duration
+}
+
+// DefaultConfig returns the configuration used when none is given.
+func DefaultConfig() Config {
+	return Config{
+		FailureThreshold: DefaultFailureThreshold,
+		CheckInterval:    DefaultCheckInterval,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("failure threshold must be at least 1")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("check interval must be positive")
+	}
+	return nil
+}
+
+type endpoint struct {
+	url    string
+	client api.ClientInterface
+
+	mu sync.Mutex
+	// consecutive failed requests and checks
+	failures int
+}
+
+func (e *endpoint) healthy(threshold int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failures < threshold
+}
+
+// record updates the health of the endpoint with the outcome of a request,
+// and returns true if it changed.
+func (e *endpoint) record(failed bool, threshold int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	wasHealthy := e.failures < threshold
+	if failed {
+		e.failures++
+	} else {
+		e.failures = 0
+	}
+	return wasHealthy != (e.failures < threshold)
+}
+
+// Client is an [api.ClientInterface] that sends each request to the first
+// healthy endpoint, in the configured order. Signing and key requests that
+// fail because the endpoint is unreachable or failing are sent again to the
+// next endpoint, as they are idempotent. Session refreshes are only sent
+// once: CubeSigner rotates the refresh token, so resending a refresh that was
+// served but whose response was lost would fail.
+//
+// Endpoint health is tracked passively from the outcome of requests, and
+// actively by Run, which checks every endpoint periodically. The session is
+// shared: the same session token authorizes requests to every endpoint.
+type Client struct {
+	endpoints []*endpoint
+	doer      api.HttpRequestDoer
+	config    Config
+	log       logging.Logger
+}
+
+// NewClient returns a client for endpoints, in order of preference. Requests
+// are sent with doer.
+func NewClient(endpoints []string, doer api.HttpRequestDoer, config Config, log logging.Logger) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errNoEndpoints
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		doer:   doer,
+		config: config,
+		log:    log,
+	}
+	for _, url := range endpoints {
+		client, err := api.NewClient(url, api.WithHTTPClient(doer))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create API client for %s: %w", url, err)
+		}
+		c.endpoints = append(c.endpoints, &endpoint{url: url, client: client})
+	}
+	return c, nil
+}
+
+// WithHedge marks the requests made with ctx as hedges of an identical request
+// that is already in flight. Hedges are sent to the second healthy endpoint
+// first, if there is one, so that they don't wait on the same endpoint.
+func WithHedge(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hedgeKey{}, true)
+}
+
+func isHedge(ctx context.Context) bool {
+	hedge, _ := ctx.Value(hedgeKey{}).(bool)
+	return hedge
+}
+
+// ordered returns the endpoints to try a request on: the healthy endpoints in
+// order of preference, followed by the unhealthy ones as a last resort.
+func (c *Client) ordered(ctx context.Context) []*endpoint {
+	var healthy, unhealthy []*endpoint
+	for _, e := range c.endpoints {
+		if e.healthy(c.config.FailureThreshold) {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	if isHedge(ctx) && len(healthy) > 1 {
+		healthy = append(healthy[1:], healthy[0])
+	}
+	return append(healthy, unhealthy...)
+}
+
+// failover sends the request with send to each endpoint in turn, until one
+// serves it. The response or error of the last endpoint is returned if none
+// does.
+func (c *Client) failover(ctx context.Context, send func(api.ClientInterface) (*http.Response, error)) (*http.Response, error) {
+	endpoints := c.ordered(ctx)
+	for i, e := range endpoints {
+		res, err := send(e.client)
+		// the caller gave up, which says nothing about the endpoint
+		if ctx.Err() != nil {
+			return res, err
+		}
+
+		failed := isFailure(res, err)
+		c.record(e, failed)
+		if !failed || i == len(endpoints)-1 {
+			return res, err
+		}
+
+		c.log.Debug("Failing over to the next CubeSigner endpoint",
+			zap.String("endpoint", e.url),
+			zap.String("next", endpoints[i+1].url),
+			zap.Error(err),
+		)
+		if res != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+	}
+	return nil, errNoEndpoints
+}
+
+// first sends the request to the first healthy endpoint only.
+func (c *Client) first(ctx context.Context, send func(api.ClientInterface) (*http.Response, error)) (*http.Response, error) {
+	e := c.ordered(ctx)[0]
+	res, err := send(e.client)
+	if ctx.Err() == nil {
+		c.record(e, isFailure(res, err))
+	}
+	return res, err
+}
+
+func (c *Client) record(e *endpoint, failed bool) {
+	if !e.record(failed, c.config.FailureThreshold) {
+		return
+	}
+	if failed {
+		c.log.Warn("CubeSigner endpoint is unhealthy", zap.String("endpoint", e.url))
+	} else {
+		c.log.Info("CubeSigner endpoint has recovered", zap.String("endpoint", e.url))
+	}
+}
+
+// isFailure returns true if a request failed because the endpoint is
+// unreachable or failing, rather than because CubeSigner rejected it.
+func isFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode >= http.StatusInternalServerError && res.StatusCode != http.StatusNotImplemented
+}
+
+func (c *Client) GetKeyInOrg(ctx context.Context, orgId string, keyId string, reqEditors ...api.RequestEditorFn) (*http.Response, error) {
+	return c.failover(ctx, func(client api.ClientInterface) (*http.Response, error) {
+		return client.GetKeyInOrg(ctx, orgId, keyId, reqEditors...)
+	})
+}
+
+// BlobSignWithBody is sent to the first healthy endpoint only, as body can
+// only be read once.
+func (c *Client) BlobSignWithBody(ctx context.Context, orgId string, keyId string, contentType string, body io.Reader, reqEditors ...api.RequestEditorFn) (*http.Response, error) {
+	return c.first(ctx, func(client api.ClientInterface) (*http.Response, error) {
+		return client.BlobSignWithBody(ctx, orgId, keyId, contentType, body, reqEditors...)
+	})
+}
+
+func (c *Client) BlobSign(ctx context.Context, orgId string, keyId string, body api.BlobSignJSONRequestBody, reqEditors ...api.RequestEditorFn) (*http.Response, error) {
+	return c.failover(ctx, func(client api.ClientInterface) (*http.Response, error) {
+		return client.BlobSign(ctx, orgId, keyId, body, reqEditors...)
+	})
+}
+
+func (c *Client) SignerSessionRefreshWithBody(ctx context.Context, orgId string, contentType string, body io.Reader, reqEditors ...api.RequestEditorFn) (*http.Response, error) {
+	return c.first(ctx, func(client api.ClientInterface) (*http.Response, error) {
+		return client.SignerSessionRefreshWithBody(ctx, orgId, contentType, body, reqEditors...)
+	})
+}
+
+func (c *Client) SignerSessionRefresh(ctx context.Context, orgId string, body api.SignerSessionRefreshJSONRequestBody, reqEditors ...api.RequestEditorFn) (*http.Response, error) {
+	return c.first(ctx, func(client api.ClientInterface) (*http.Response, error) {
+		return client.SignerSessionRefresh(ctx, orgId, body, reqEditors...)
+	})
+}
+
+// Run checks every endpoint each CheckInterval until ctx is cancelled. An
+// endpoint passes the check if it responds without a server error, which
+// doesn't require a session.
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, e := range c.endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.check(ctx, e)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func (c *Client) check(ctx context.Context, e *endpoint) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.CheckInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url, nil)
+	if err != nil {
+		c.record(e, true)
+		return
+	}
+	res, err := c.doer.Do(req)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	}
+	// shutting down
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	failed := isFailure(res, err)
+	if failed {
+		c.log.Debug("CubeSigner endpoint check failed", zap.String("endpoint", e.url), zap.Error(err))
+	}
+	c.record(e, failed)
+}
+
+// HealthCheck returns a check that fails if none of the endpoints are healthy.
+func (c *Client) HealthCheck() health.CheckerOption {
+	return health.WithCheck(health.Check{
+		Name:  "cubesigner-endpoints",
+		Check: c.checkEndpoints,
+	})
+}
+
+func (c *Client) checkEndpoints(context.Context) error {
+	for _, e := range c.endpoints {
+		if e.healthy(c.config.FailureThreshold) {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the %d CubeSigner endpoints are healthy", len(c.endpoints))
+}
+
+// Collectors returns the metrics reporting the health of each endpoint.
+func (c *Client) Collectors() []prometheus.Collector {
+	collectors := make([]prometheus.Collector, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		collectors = append(collectors, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "endpoint_healthy",
+				Help:        "Whether the CubeSigner endpoint is healthy, 1 if it is and 0 otherwise",
+				ConstLabels: prometheus.Labels{"endpoint": e.url},
+			},
+			func() float64 {
+				if e.healthy(c.config.FailureThreshold) {
+					return 1
+				}
+				return 0
+			},
+		))
+	}
+	return collectors
+}
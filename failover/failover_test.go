@@ -0,0 +1,173 @@
+package failover
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// testEndpoint is a CubeSigner endpoint that responds with status, and counts
+// the requests it receives.
+type testEndpoint struct {
+	*httptest.Server
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func newTestEndpoint(t *testing.T) *testEndpoint {
+	t.Helper()
+	e := &testEndpoint{}
+	e.status.Store(http.StatusOK)
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		e.requests.Add(1)
+		w.WriteHeader(int(e.status.Load()))
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func newTestClient(t *testing.T, endpoints ...string) *Client {
+	t.Helper()
+	c, err := NewClient(endpoints, http.DefaultClient, Config{FailureThreshold: 1, CheckInterval: time.Second}, logging.NoLog{})
+	require.NoError(t, err)
+	return c
+}
+
+func getKey(t *testing.T, c *Client) int {
+	t.Helper()
+	res, err := c.GetKeyInOrg(context.Background(), "org-id", "key-id")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	return res.StatusCode
+}
+
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultConfig().Validate())
+	require.Error(t, Config{FailureThreshold: 0, CheckInterval: time.Second}.Validate())
+	require.Error(t, Config{FailureThreshold: 1, CheckInterval: 0}.Validate())
+}
+
+func TestClientFailover(t *testing.T) {
+	require := require.New(t)
+	primary := newTestEndpoint(t)
+	secondary := newTestEndpoint(t)
+	c := newTestClient(t, primary.URL, secondary.URL)
+
+	require.Equal(http.StatusOK, getKey(t, c))
+	require.Equal(int32(1), primary.requests.Load())
+	require.Zero(secondary.requests.Load())
+
+	// failed over to the secondary endpoint, and the primary is no longer
+	// tried first
+	primary.status.Store(http.StatusServiceUnavailable)
+	require.Equal(http.StatusOK, getKey(t, c))
+	require.Equal(http.StatusOK, getKey(t, c))
+	require.Equal(int32(2), primary.requests.Load())
+	require.Equal(int32(2), secondary.requests.Load())
+	require.InDelta(0, testutil.ToFloat64(c.Collectors()[0]), 0)
+	require.InDelta(1, testutil.ToFloat64(c.Collectors()[1]), 0)
+
+	// requests CubeSigner rejects are not failed over
+	secondary.status.Store(http.StatusForbidden)
+	require.Equal(http.StatusForbidden, getKey(t, c))
+	require.Equal(int32(2), primary.requests.Load())
+
+	// the primary endpoint is used again once the check passes
+	primary.status.Store(http.StatusOK)
+	c.check(context.Background(), c.endpoints[0])
+	require.Equal(http.StatusOK, getKey(t, c))
+	require.Equal(int32(4), primary.requests.Load())
+}
+
+func TestClientFailoverUnreachable(t *testing.T) {
+	require := require.New(t)
+	primary := newTestEndpoint(t)
+	secondary := newTestEndpoint(t)
+	c := newTestClient(t, primary.URL, secondary.URL)
+
+	primary.Close()
+	res, err := c.BlobSign(context.Background(), "org-id", "key-id", api.BlobSignJSONRequestBody{})
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(int32(1), secondary.requests.Load())
+	require.False(c.endpoints[0].healthy(c.config.FailureThreshold))
+}
+
+func TestClientRefreshNotFailedOver(t *testing.T) {
+	require := require.New(t)
+	primary := newTestEndpoint(t)
+	secondary := newTestEndpoint(t)
+	c := newTestClient(t, primary.URL, secondary.URL)
+
+	primary.status.Store(http.StatusServiceUnavailable)
+	res, err := c.SignerSessionRefresh(context.Background(), "org-id", api.SignerSessionRefreshJSONRequestBody{})
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	require.Zero(secondary.requests.Load())
+
+	// the next refresh goes to the secondary endpoint, as the primary is
+	// unhealthy
+	res, err = c.SignerSessionRefresh(context.Background(), "org-id", api.SignerSessionRefreshJSONRequestBody{})
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal(int32(1), secondary.requests.Load())
+}
+
+func TestClientHealthCheck(t *testing.T) {
+	require := require.New(t)
+	primary := newTestEndpoint(t)
+	secondary := newTestEndpoint(t)
+	c := newTestClient(t, primary.URL, secondary.URL)
+
+	check := func() error {
+		for _, e := range c.endpoints {
+			c.check(context.Background(), e)
+		}
+		return c.checkEndpoints(context.Background())
+	}
+
+	// only fails once none of the endpoints are healthy
+	primary.status.Store(http.StatusBadGateway)
+	require.NoError(check())
+	require.False(c.endpoints[0].healthy(c.config.FailureThreshold))
+
+	secondary.Close()
+	require.ErrorContains(check(), "none of the 2 CubeSigner endpoints are healthy")
+
+	// any response other than a server error passes the check
+	primary.status.Store(http.StatusNotFound)
+	require.NoError(check())
+}
+
+func TestClientHedge(t *testing.T) {
+	require := require.New(t)
+	primary := newTestEndpoint(t)
+	secondary := newTestEndpoint(t)
+	c := newTestClient(t, primary.URL, secondary.URL)
+
+	// hedges go to the second healthy endpoint
+	res, err := c.BlobSign(WithHedge(context.Background()), "org-id", "key-id", api.BlobSignJSONRequestBody{})
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Zero(primary.requests.Load())
+	require.Equal(int32(1), secondary.requests.Load())
+
+	// or to the only healthy one
+	secondary.status.Store(http.StatusServiceUnavailable)
+	require.Equal(http.StatusOK, getKey(t, c))
+	res, err = c.BlobSign(WithHedge(context.Background()), "org-id", "key-id", api.BlobSignJSONRequestBody{})
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(int32(2), primary.requests.Load())
+	require.Equal(int32(2), secondary.requests.Load())
+}
@@ -0,0 +1,216 @@
+// Package listener creates the listeners of the signer gRPC server, on TCP
+// addresses or unix domain sockets.
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+
+	unixScheme = "unix://"
+
+	// socketUmask leaves only the owner's permissions on new sockets
+	socketUmask = 0o177
+)
+
+var errNotSocket = errors.New("file exists and is not a socket")
+
+// Address is a parsed listen address
+type Address struct {
+	Network string
+	Address string
+}
+
+func (a Address) String() string {
+	if a.Network == NetworkUnix {
+		return unixScheme + a.Address
+	}
+	return a.Address
+}
+
+// ParseAddress parses a listen address, which is either a unix socket path in
+// the form unix:///path/to/socket, or a TCP host:port where host is an IPv4 or
+// IPv6 address. IPv6 addresses must be enclosed in brackets, as in [::1]:50051.
+func ParseAddress(addr string) (Address, error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if !strings.HasPrefix(path, "/") {
+			return Address{}, fmt.Errorf("unix socket path must be absolute: %s", addr)
+		}
+		return Address{Network: NetworkUnix, Address: path}, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid listen address %s: %w", addr, err)
+	}
+	if host != "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return Address{}, fmt.Errorf("invalid listen address %s: host must be an IPv4 or IPv6 address", addr)
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return Address{}, fmt.Errorf("invalid listen address %s: invalid port %q", addr, port)
+	}
+	return Address{Network: NetworkTCP, Address: addr}, nil
+}
+
+// IsLocal returns true if addr can only be reached from the local host, i.e.
+// it is a unix socket or a loopback IP address.
+func (a Address) IsLocal() bool {
+	if a.Network == NetworkUnix {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(a.Address)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// SocketOptions configure the permissions of unix sockets
+type SocketOptions struct {
+	Mode fs.FileMode
+	// UID and GID of the socket owner, -1 to keep the process' own
+	UID int
+	GID int
+}
+
+// Listen listens on addr. Unix sockets are created with the permissions in
+// opts, replacing any stale socket left at the same path.
+func Listen(ctx context.Context, addr Address, opts SocketOptions) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if addr.Network != NetworkUnix {
+		return lc.Listen(ctx, addr.Network, addr.Address)
+	}
+
+	if err := removeStaleSocket(addr.Address); err != nil {
+		return nil, err
+	}
+
+	lis, err := listenUnix(ctx, &lc, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The mode is relaxed only once the socket has its final owner
+	if opts.UID != -1 || opts.GID != -1 {
+		if err := os.Chown(addr.Address, opts.UID, opts.GID); err != nil {
+			_ = lis.Close()
+			return nil, fmt.Errorf("failed to set owner of %s: %w", addr.Address, err)
+		}
+	}
+
+	if err := os.Chmod(addr.Address, opts.Mode); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("failed to set mode of %s: %w", addr.Address, err)
+	}
+	return lis, nil
+}
+
+var umaskLock sync.Mutex
+
+// listenUnix creates a unix socket that only its owner can connect to, so
+// that nobody else can connect before its permissions are set. The umask is
+// process-wide, so files created concurrently by other goroutines are also
+// restricted while the socket is created.
+func listenUnix(ctx context.Context, lc *net.ListenConfig, path string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+
+	umask := syscall.Umask(socketUmask)
+	defer syscall.Umask(umask)
+	return lc.Listen(ctx, NetworkUnix, path)
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("failed to listen on %s: %w", path, errNotSocket)
+	}
+	return os.Remove(path)
+}
+
+// ParseSocketMode parses an octal file mode, such as "0660".
+func ParseSocketMode(mode string) (fs.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > uint64(fs.ModePerm) {
+		return 0, fmt.Errorf("invalid socket mode %q, must be an octal permission such as 0660", mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// ParseSocketOwner parses an owner in the form user[:group], where user and
+// group are names or numeric IDs. An empty owner keeps the process' own.
+func ParseSocketOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+
+	uid := -1
+	if userName != "" {
+		id, err := lookupID(userName, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid socket owner %q: %w", owner, err)
+		}
+		uid = id
+	}
+
+	gid := -1
+	if hasGroup && groupName != "" {
+		id, err := lookupID(groupName, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid socket group %q: %w", owner, err)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
+
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,149 @@
+package listener
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected Address
+		err      bool
+	}{
+		{addr: "127.0.0.1:50051", expected: Address{Network: NetworkTCP, Address: "127.0.0.1:50051"}},
+		{addr: "[::1]:50051", expected: Address{Network: NetworkTCP, Address: "[::1]:50051"}},
+		{addr: ":50051", expected: Address{Network: NetworkTCP, Address: ":50051"}},
+		{addr: "unix:///run/signer.sock", expected: Address{Network: NetworkUnix, Address: "/run/signer.sock"}},
+		{addr: "unix://signer.sock", err: true},
+		{addr: "localhost", err: true},
+		{addr: "localhost:50051", err: true},
+		{addr: "::1:50051", err: true},
+		{addr: "127.0.0.1:http", err: true},
+		{addr: "127.0.0.1:65536", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			require := require.New(t)
+
+			addr, err := ParseAddress(tt.addr)
+			if tt.err {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.expected, addr)
+			require.Equal(tt.addr, addr.String())
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	addr := Address{Network: NetworkUnix, Address: path}
+	opts := SocketOptions{Mode: 0660, UID: -1, GID: -1}
+
+	// Leave a stale socket behind, as after a crash
+	stale, err := net.Listen(NetworkUnix, path)
+	require.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(stale.Close())
+
+	lis, err := Listen(context.Background(), addr, opts)
+	require.NoError(err)
+	defer lis.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(fs.ModeSocket, info.Mode().Type())
+	require.Equal(fs.FileMode(0660), info.Mode().Perm())
+
+	conn, err := net.Dial(NetworkUnix, path)
+	require.NoError(err)
+	require.NoError(conn.Close())
+}
+
+func TestListenUnixUmask(t *testing.T) {
+	require := require.New(t)
+
+	umask := syscall.Umask(0o022)
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	lis, err := listenUnix(context.Background(), &net.ListenConfig{}, path)
+	require.NoError(err)
+	defer lis.Close()
+
+	// the socket is only open to its owner until its mode is set
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(fs.FileMode(0600), info.Mode().Perm())
+
+	// and the process' umask is restored
+	require.Equal(0o022, syscall.Umask(0o022))
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	_, err := Listen(context.Background(), Address{Network: NetworkUnix, Address: path}, SocketOptions{Mode: 0600, UID: -1, GID: -1})
+	require.ErrorIs(t, err, errNotSocket)
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	require := require.New(t)
+
+	uid, gid, err := ParseSocketOwner("")
+	require.NoError(err)
+	require.Equal(-1, uid)
+	require.Equal(-1, gid)
+
+	uid, gid, err = ParseSocketOwner("1000:1001")
+	require.NoError(err)
+	require.Equal(1000, uid)
+	require.Equal(1001, gid)
+
+	uid, gid, err = ParseSocketOwner(":1001")
+	require.NoError(err)
+	require.Equal(-1, uid)
+	require.Equal(1001, gid)
+
+	_, _, err = ParseSocketOwner("no-such-user-for-tests")
+	require.Error(err)
+}
+
+func TestAddressIsLocal(t *testing.T) {
+	tests := []struct {
+		addr  string
+		local bool
+	}{
+		{addr: "127.0.0.1:50051", local: true},
+		{addr: "127.1.2.3:50051", local: true},
+		{addr: "[::1]:50051", local: true},
+		{addr: "unix:///run/signer.sock", local: true},
+		{addr: ":50051", local: false},
+		{addr: "0.0.0.0:50051", local: false},
+		{addr: "[::]:50051", local: false},
+		{addr: "10.0.0.1:50051", local: false},
+		{addr: "[2001:db8::1]:50051", local: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr, err := ParseAddress(tt.addr)
+			require.NoError(t, err)
+			require.Equal(t, tt.local, addr.IsLocal())
+		})
+	}
+}
@@ -2,21 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/alexliesenfeld/health"
 	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/logging"
 	"github.com/ava-labs/cube-signer-sidecar/api"
 	"github.com/ava-labs/cube-signer-sidecar/config"
+	"github.com/ava-labs/cube-signer-sidecar/failover"
+	"github.com/ava-labs/cube-signer-sidecar/listener"
 	"github.com/ava-labs/cube-signer-sidecar/signerserver"
+	"github.com/ava-labs/cube-signer-sidecar/tlsconfig"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/ava-labs/cube-signer-sidecar/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+const (
+	exitCodeError        = 1
+	exitCodeDrainTimeout = 2
+)
+
+var errDrainTimeout = errors.New("timed out waiting for in-flight requests to finish")
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == tokenCommand {
+		if err := runTokenCommand(os.Args[2:]); err != nil {
+			log.Fatalf("%s: %s", tokenCommand, err)
+		}
+		return
+	}
+
 	fs := config.BuildFlagSet()
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("couldn't parse flags: %s", err)
@@ -43,59 +74,369 @@ func main() {
 		log.Fatalf("couldn't build config: %s", err)
 	}
 
-	if err := runServer(cfg); err != nil {
-		log.Fatalf("failed to run server: %v", err)
+	logger, err := newLogger(cfg)
+	if err != nil {
+		log.Fatalf("couldn't create logger: %s", err)
 	}
-	log.Println("server exited gracefully")
+	defer logger.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle os signals
+	go handleSystemSignals(ctx, cancel, logger)
+
+	if err := runServer(ctx, cfg, logger); err != nil {
+		logger.Fatal("Failed to run server", zap.Error(err))
+		logger.Stop()
+		os.Exit(exitCode(err))
+	}
+	logger.Info("Server exited gracefully")
+}
+
+// exitCode returns the process exit code for the error returned by runServer.
+func exitCode(err error) int {
+	if errors.Is(err, errDrainTimeout) {
+		return exitCodeDrainTimeout
+	}
+	return exitCodeError
 }
 
-func runServer(cfg config.Config) error {
-	client, err := api.NewClientWithResponses(cfg.SignerEndpoint)
+func newLogger(cfg config.Config) (logging.Logger, error) {
+	level, err := logging.ToLevel(cfg.LogLevel)
 	if err != nil {
-		return fmt.Errorf("failed to create API client: %w", err)
+		return nil, err
 	}
 
-	signerServer, err := signerserver.New(cfg.KeyID, cfg.TokenFilePath, client)
+	format, err := logging.ToFormat(cfg.LogFormat, os.Stdout.Fd())
 	if err != nil {
-		return fmt.Errorf("failed to create signer server: %w", err)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	return logging.NewLogger(
+		"cube-signer-sidecar",
+		logging.NewWrappedCore(level, os.Stdout, format.ConsoleEncoder()),
+	), nil
+}
+
+// runServer serves until ctx is cancelled or serving fails, then shuts down,
+// letting in-flight RPCs finish within the shutdown timeout.
+func runServer(ctx context.Context, cfg config.Config, logger logging.Logger) error {
+	tracerProvider, shutdownTracing, err := tracing.New(context.Background(), cfg.TracingConfig())
+	if err != nil {
+		return fmt.Errorf("failed to configure tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Warn("Failed to flush traces", zap.Error(err))
+		}
+	}()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Handle os signals
-	go handleSystemSignals(cancel)
+	var healthChecks []health.CheckerOption
+	httpClient := tracing.NewHTTPClient(tracerProvider, nil)
+	client, err := api.NewClientWithResponses(cfg.SignerEndpoints[0], api.WithHTTPClient(httpClient))
+	if err != nil {
+		return fmt.Errorf("failed to create API client: %w", err)
+	}
+	if len(cfg.SignerEndpoints) > 1 {
+		failoverClient, err := failover.NewClient(cfg.SignerEndpoints, httpClient, cfg.FailoverConfig(), logger)
+		if err != nil {
+			return fmt.Errorf("failed to create API client: %w", err)
+		}
+		go failoverClient.Run(ctx)
+		registry.MustRegister(failoverClient.Collectors()...)
+		healthChecks = append(healthChecks, failoverClient.HealthCheck())
+		client = &api.ClientWithResponses{ClientInterface: failoverClient}
+	}
+
+	serverOpts := []grpc.ServerOption{tracing.ServerOption(tracerProvider)}
+	if cfg.TLSEnabled() {
+		tlsConfig, err := tlsconfig.NewServerConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, logger)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	socketOpts, err := cfg.SocketOptions()
+	if err != nil {
+		return err
+	}
+
+	// Read once for all keys, as a file descriptor can only be read once
+	encryptionKey, err := cfg.ReadTokenEncryptionKey()
+	if err != nil {
+		return err
+	}
+
+	var (
+		keyServers   []*keyServer
+		httpServers  []*http.Server
+		numListeners int
+		started      bool
+	)
+	// If starting fails, stop the keys and HTTP servers already started
+	defer func() {
+		if started {
+			return
+		}
+		cancel()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer shutdownCancel()
+		if err := shutdown(shutdownCtx, keyServers, httpServers); err != nil {
+			logger.Warn("Failed to shut down after failing to start", zap.Error(err))
+		}
+	}()
+
+	for _, keyCfg := range cfg.SignerKeys() {
+		store, err := cfg.TokenStore(keyCfg, encryptionKey, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create token store for key %s: %w", keyCfg.KeyID, err)
+		}
+
+		keyServer, err := newKeyServer(ctx, keyCfg, store, cfg.RefreshConfig(), cfg.RetryConfig(), cfg.BreakerConfig(), cfg.HedgeConfig(), client, registry, serverOpts, socketOpts, logger)
+		if err != nil {
+			return err
+		}
+		keyServers = append(keyServers, keyServer)
+		numListeners += len(keyServer.listeners)
+		healthChecks = append(healthChecks, keyServer.signerServer.HealthChecks()...)
+	}
+
+	healthMux := http.NewServeMux()
+	api.HandleHealthCheck(healthMux, healthChecks...)
+	healthServer, err := startHTTPServer(ctx, logger, "health", cfg.HTTPAddress(cfg.HealthPort), healthMux)
+	if err != nil {
+		return err
+	}
+	httpServers = append(httpServers, healthServer)
+
+	metricsMux := http.NewServeMux()
+	api.HandleMetrics(metricsMux, registry)
+	metricsServer, err := startHTTPServer(ctx, logger, "metrics", cfg.HTTPAddress(cfg.MetricsPort), metricsMux)
+	if err != nil {
+		return err
+	}
+	httpServers = append(httpServers, metricsServer)
+	started = true
+
+	serveErr := make(chan error, numListeners)
+	for _, keyServer := range keyServers {
+		for _, lis := range keyServer.listeners {
+			go func() {
+				keyServer.log.Info("Starting gRPC server", zap.Stringer("address", lis.Addr()))
+				serveErr <- keyServer.grpcServer.Serve(lis)
+			}()
+		}
+	}
+
+	var errs []error
+	select {
+	case err := <-serveErr:
+		errs = append(errs, fmt.Errorf("failed to serve: %w", err))
+		cancel()
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down", zap.Duration("timeout", cfg.ShutdownTimeout))
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer shutdownCancel()
+
+	if err := shutdown(shutdownCtx, keyServers, httpServers); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// shutdown stops the key servers, letting their in-flight RPCs finish, and
+// then the HTTP servers.
+func shutdown(ctx context.Context, keyServers []*keyServer, httpServers []*http.Server) error {
+	var (
+		wg    sync.WaitGroup
+		errMu sync.Mutex
+		errs  []error
+	)
+	for _, keyServer := range keyServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := keyServer.shutdown(ctx); err != nil {
+				errMu.Lock()
+				errs = append(errs, err)
+				errMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, server := range httpServers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down HTTP server: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// keyServer serves a single key on its own gRPC listeners
+type keyServer struct {
+	signerServer *signerserver.SignerServer
+	grpcServer   *grpc.Server
+	healthServer *grpchealth.Server
+	listeners    []net.Listener
+	log          logging.Logger
+}
+
+func newKeyServer(
+	ctx context.Context,
+	cfg config.SignerKeyConfig,
+	store tokenstore.TokenStore,
+	refreshConfig signerserver.RefreshConfig,
+	retryConfig signerserver.RetryConfig,
+	breakerConfig signerserver.BreakerConfig,
+	hedgeConfig signerserver.HedgeConfig,
+	client *api.ClientWithResponses,
+	registry prometheus.Registerer,
+	serverOpts []grpc.ServerOption,
+	socketOpts listener.SocketOptions,
+	logger logging.Logger,
+) (*keyServer, error) {
+	logger = logger.With(zap.String("keyID", cfg.KeyID))
+	registry = prometheus.WrapRegistererWith(prometheus.Labels{"key_id": cfg.KeyID}, registry)
+
+	addrs, err := cfg.Addresses()
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address for key %s: %w", cfg.KeyID, err)
+	}
+
+	// Listen first, so that nothing is left running if it fails
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		lis, err := listener.Listen(ctx, addr, socketOpts)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("failed to start gRPC server for key %s: %w", cfg.KeyID, err)
+		}
+		listeners = append(listeners, lis)
+	}
+
+	signerServer, err := signerserver.New(ctx, cfg.KeyID, store, client, refreshConfig, retryConfig, breakerConfig, hedgeConfig, registry, logger)
+	if err != nil {
+		closeListeners(listeners)
+		return nil, fmt.Errorf("failed to create signer server for key %s: %w", cfg.KeyID, err)
+	}
 
 	signerServer.StartBackgroundTokenRefresh(ctx)
+	signerServer.WatchTokenStore(ctx)
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(serverOpts...)
 	signer.RegisterSignerServer(grpcServer, signerServer)
 
-	port := strconv.Itoa(int(cfg.Port))
+	healthServer := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	signerServer.SetHealthServer(healthServer)
+
+	// Resolve the public key up front so that the signer reports as ready
+	// without waiting for the first request.
+	if _, err := signerServer.PublicKey(ctx, &signer.PublicKeyRequest{}); err != nil {
+		logger.Warn("Failed to resolve public key", zap.Error(err))
+	}
+
+	return &keyServer{
+		signerServer: signerServer,
+		grpcServer:   grpcServer,
+		healthServer: healthServer,
+		listeners:    listeners,
+		log:          logger,
+	}, nil
+}
+
+// shutdown stops serving the key, waiting for in-flight RPCs to finish, and
+// persists its token data.
+func (k *keyServer) shutdown(ctx context.Context) error {
+	k.healthServer.Shutdown()
+
+	var errs []error
+	if err := drain(ctx, k.grpcServer); err != nil {
+		errs = append(errs, err)
+	}
+	// The gRPC server only closes the listeners it has started serving
+	closeListeners(k.listeners)
+
+	if err := k.signerServer.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush token data: %w", err))
+	}
+	return errors.Join(errs...)
+}
 
+func closeListeners(listeners []net.Listener) {
+	for _, lis := range listeners {
+		_ = lis.Close()
+	}
+}
+
+// drain gracefully stops grpcServer, waiting for in-flight RPCs to finish. If
+// ctx expires first, the remaining RPCs are cancelled.
+func drain(ctx context.Context, grpcServer *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		grpcServer.Stop()
+		<-stopped
+		return errDrainTimeout
+	}
+}
+
+// startHTTPServer listens on port and serves handler in the background.
+func startHTTPServer(ctx context.Context, logger logging.Logger, name string, addr listener.Address, handler http.Handler) (*http.Server, error) {
 	lc := net.ListenConfig{}
-	lis, err := lc.Listen(ctx, "tcp", ":"+port)
+	lis, err := lc.Listen(ctx, addr.Network, addr.Address)
 	if err != nil {
-		return fmt.Errorf("failed to start gRPC server: %w", err)
+		return nil, fmt.Errorf("failed to start %s server: %w", name, err)
 	}
 
-	api.HandleHealthCheck()
-
-	log.Printf("Starting gRPC server on port %s...", port)
-	if err := grpcServer.Serve(lis); err != nil {
-		return fmt.Errorf("failed to serve: %w", err)
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	return nil
+	go func() {
+		logger.Info("Starting HTTP server", zap.String("name", name), zap.Stringer("address", lis.Addr()))
+		if err := server.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", zap.String("name", name), zap.Error(err))
+		}
+	}()
+
+	return server, nil
 }
 
-func handleSystemSignals(cancel context.CancelFunc) {
+func handleSystemSignals(ctx context.Context, cancel context.CancelFunc, logger logging.Logger) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, os.Kill)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
 
-	sig := <-sigChan
-	log.Printf("Received os signal: %s", sig.String())
+	select {
+	case sig := <-sigChan:
+		logger.Info("Received os signal", zap.Stringer("signal", sig))
+	case <-ctx.Done():
+		return
+	}
 
 	// Cancel the parent context
 	cancel()
-}
\ No newline at end of file
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	testOrgID = "Org-test"
+	testKeyID = "Key-test"
+)
+
+// fakeCubeSigner serves the public key of a local signer and signs with it.
+// Sign requests are held until release is closed or the request is cancelled,
+// and session refreshes until refreshRelease is closed.
+type fakeCubeSigner struct {
+	*httptest.Server
+	signer *localsigner.LocalSigner
+	// receives every sign request once it is held
+	signing chan struct{}
+	release chan struct{}
+	// receives every refresh once it is held
+	refreshing     chan struct{}
+	refreshRelease chan struct{}
+}
+
+func newFakeCubeSigner(t *testing.T) *fakeCubeSigner {
+	localSigner, err := localsigner.New()
+	require.NoError(t, err)
+
+	f := &fakeCubeSigner{
+		signer:         localSigner,
+		signing:        make(chan struct{}, 10),
+		release:        make(chan struct{}),
+		refreshing:     make(chan struct{}, 10),
+		refreshRelease: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("GET /v0/org/%s/keys/%s", testOrgID, testKeyID), f.getKey)
+	mux.HandleFunc(fmt.Sprintf("POST /v1/org/%s/blob/sign/%s", testOrgID, testKeyID), f.sign)
+	mux.HandleFunc(fmt.Sprintf("PATCH /v1/org/%s/token/refresh", testOrgID), f.refresh)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeCubeSigner) getKey(w http.ResponseWriter, _ *http.Request) {
+	pk := bls.PublicKeyToCompressedBytes(f.signer.PublicKey())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"public_key": "0x" + hex.EncodeToString(pk)})
+}
+
+func (f *fakeCubeSigner) sign(w http.ResponseWriter, r *http.Request) {
+	var req api.BlobSignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := base64.StdEncoding.DecodeString(req.MessageBase64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.signing <- struct{}{}
+	select {
+	case <-f.release:
+	case <-r.Context().Done():
+		return
+	}
+
+	sig, err := f.signer.Sign(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(api.SignResponse{
+		Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+	})
+}
+
+func (f *fakeCubeSigner) refresh(w http.ResponseWriter, _ *http.Request) {
+	f.refreshing <- struct{}{}
+	<-f.refreshRelease
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(newTestSession("refreshed-token", time.Now().Add(time.Hour)))
+}
+
+// newTestSession returns the token data of a session whose session token
+// expires at authTokenExp.
+func newTestSession(token string, authTokenExp time.Time) map[string]any {
+	expiry := time.Now().Add(24 * time.Hour).Unix()
+	return map[string]any{
+		"org_id":        testOrgID,
+		"role_id":       "Role-test",
+		"token":         token,
+		"refresh_token": "test-refresh-token",
+		"expiration":    expiry,
+		"session_info": map[string]any{
+			"auth_token":        "test-auth-token",
+			"auth_token_exp":    authTokenExp.Unix(),
+			"refresh_token":     "test-refresh-token",
+			"refresh_token_exp": expiry,
+			"session_id":        "test-session",
+		},
+	}
+}
+
+// newTestConfig returns the configuration of a server for the key of
+// upstream, listening on a unix socket in a temporary directory, and with its
+// session token expiring at authTokenExp. It returns the paths of the socket
+// and of the token file.
+func newTestConfig(t *testing.T, upstream *fakeCubeSigner, shutdownTimeout time.Duration, authTokenExp time.Time) (config.Config, string, string) {
+	t.Helper()
+	require := require.New(t)
+
+	dir := t.TempDir()
+	tokenData, err := json.Marshal(newTestSession("test-token", authTokenExp))
+	require.NoError(err)
+	tokenFile := filepath.Join(dir, "token.json")
+	require.NoError(os.WriteFile(tokenFile, tokenData, 0600))
+
+	socket := filepath.Join(dir, "signer.sock")
+	configJSON, err := json.Marshal(map[string]any{
+		"signer-endpoint":  upstream.URL,
+		"key-id":           testKeyID,
+		"token-file-path":  tokenFile,
+		"listen-address":   "unix://" + socket,
+		"shutdown-timeout": shutdownTimeout.String(),
+	})
+	require.NoError(err)
+	configFile := filepath.Join(dir, "config.json")
+	require.NoError(os.WriteFile(configFile, configJSON, 0600))
+
+	fs := config.BuildFlagSet()
+	require.NoError(fs.Parse([]string{"--" + config.ConfigFileKey, configFile}))
+	v, err := config.BuildViper(fs)
+	require.NoError(err)
+	cfg, err := config.NewConfig(v)
+	require.NoError(err)
+
+	// serve health checks and metrics on any free port
+	cfg.HealthPort = 0
+	cfg.MetricsPort = 0
+	return cfg, socket, tokenFile
+}
+
+// startServer runs the server for cfg until ctx is cancelled. It returns a
+// client of the server once it is serving, and the channel that receives the
+// result of runServer.
+func startServer(t *testing.T, ctx context.Context, cfg config.Config, socket string) (signer.SignerClient, <-chan error) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, cfg, logging.NoLog{})
+	}()
+
+	client := newSignerClient(t, socket)
+	require.Eventually(t, func() bool {
+		_, err := client.PublicKey(ctx, &signer.PublicKeyRequest{})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return client, done
+}
+
+func newSignerClient(t *testing.T, socket string) signer.SignerClient {
+	t.Helper()
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return signer.NewSignerClient(conn)
+}
+
+func TestRunServerDrainsInFlightRequests(t *testing.T) {
+	require := require.New(t)
+
+	upstream := newFakeCubeSigner(t)
+	cfg, socket, _ := newTestConfig(t, upstream, 10*time.Second, time.Now().Add(time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, done := startServer(t, ctx, cfg, socket)
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := client.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+		signed <- err
+	}()
+	<-upstream.signing
+
+	// once the server is shutting down, no new connections are accepted
+	cancel()
+	require.Eventually(func() bool {
+		_, err := newSignerClient(t, socket).PublicKey(context.Background(), &signer.PublicKeyRequest{})
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// but the in-flight request still completes
+	close(upstream.release)
+	require.NoError(<-signed)
+	require.NoError(<-done)
+}
+
+func TestRunServerDrainTimeout(t *testing.T) {
+	require := require.New(t)
+
+	upstream := newFakeCubeSigner(t)
+	// the session token has expired, so it is refreshed on startup
+	cfg, socket, tokenFile := newTestConfig(t, upstream, 100*time.Millisecond, time.Now().Add(-time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, done := startServer(t, ctx, cfg, socket)
+	<-upstream.refreshing
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := client.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+		signed <- err
+	}()
+	<-upstream.signing
+
+	// requests still in flight when the shutdown timeout expires are cancelled
+	cancel()
+	require.Error(<-signed)
+
+	// the refresh in flight completes after the shutdown timeout
+	close(upstream.refreshRelease)
+	err := <-done
+	require.ErrorIs(err, errDrainTimeout)
+	require.Equal(exitCodeDrainTimeout, exitCode(err))
+
+	// and the session it obtained is still saved
+	saved, err := os.ReadFile(tokenFile)
+	require.NoError(err)
+	var session struct {
+		Token string `json:"token"`
+	}
+	require.NoError(json.Unmarshal(saved, &session))
+	require.Equal("refreshed-token", session.Token)
+}
+
+func TestRunServerStartFailure(t *testing.T) {
+	require := require.New(t)
+
+	upstream := newFakeCubeSigner(t)
+	cfg, socket, _ := newTestConfig(t, upstream, 10*time.Second, time.Now().Add(time.Hour))
+
+	// the health server can't listen on a port that is already used
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer lis.Close()
+	cfg.HealthPort = uint16(lis.Addr().(*net.TCPAddr).Port)
+
+	err = runServer(context.Background(), cfg, logging.NoLog{})
+	require.ErrorContains(err, "failed to start health server")
+
+	// and the key already started is shut down
+	_, err = os.Stat(socket)
+	require.ErrorIs(err, fs.ErrNotExist)
+}
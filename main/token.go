@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ava-labs/cube-signer-sidecar/config"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/spf13/pflag"
+)
+
+const (
+	tokenCommand = "token"
+	stdio        = "-"
+)
+
+// runTokenCommand runs `token encrypt` or `token decrypt`, which convert
+// token files between plaintext and encrypted token data, e.g. to encrypt
+// existing token files when enabling token-encryption-key.
+func runTokenCommand(args []string) error {
+	fs := pflag.NewFlagSet(tokenCommand, pflag.ContinueOnError)
+	keySource := fs.String(config.TokenEncryptionKeyKey, "", "Where to read the token encryption key, one of env:NAME, file:PATH or fd:N")
+	in := fs.String("in", stdio, "Token file to read, - for stdin")
+	out := fs.String("out", stdio, "Token file to write, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s encrypt|decrypt [flags]\n\n", os.Args[0], tokenCommand)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *keySource == "" {
+		fs.Usage()
+		return errors.New("a subcommand and --" + config.TokenEncryptionKeyKey + " are required")
+	}
+
+	key, err := tokenstore.ReadKey(*keySource)
+	if err != nil {
+		return err
+	}
+	data, err := readInput(*in)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "encrypt":
+		if tokenstore.IsEncrypted(data) {
+			return errors.New("token data is already encrypted")
+		}
+		if !json.Valid(data) {
+			return errors.New("token data is not valid JSON")
+		}
+		data, err = tokenstore.Encrypt(key, data)
+	case "decrypt":
+		data, err = tokenstore.Decrypt(key, data)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown subcommand %q", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, data)
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == stdio {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// writeOutput replaces the file at path with data, so that the input can be
+// converted in place.
+func writeOutput(path string, data []byte) error {
+	if path == stdio {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return tokenstore.WriteFileAtomic(path, data)
+}
@@ -0,0 +1,290 @@
+package signerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBreakerErrorRate      = 0.5
+	DefaultBreakerMinRequests    = 20
+	DefaultBreakerWindow         = 30 * time.Second
+	DefaultBreakerOpenDuration   = 15 * time.Second
+	DefaultBreakerHalfOpenProbes = 3
+
+	// breakerBuckets is the number of buckets the window is split into, so
+	// that old outcomes expire gradually
+	breakerBuckets = 10
+)
+
+var errCircuitOpen = errors.New("CubeSigner is failing, requests are rejected until it recovers")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets every request through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe requests through
+	BreakerHalfOpen
+)
+
+// breakerStates lists every state, in order.
+var breakerStates = []BreakerState{
+	BreakerClosed,
+	BreakerOpen,
+	BreakerHalfOpen,
+}
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig configures the circuit breaker around CubeSigner requests.
+type BreakerConfig struct {
+	// ErrorRate is the fraction of failed requests in Window that opens the
+	// circuit, 0 disables the circuit breaker.
+	ErrorRate float64
+	// MinRequests is the number of requests in Window below which the circuit
+	// isn't opened, whatever the error rate.
+	MinRequests int
+	// Window is how far back requests count towards the error rate.
+	Window time.Duration
+	// OpenDuration is how long the circuit stays open before probe requests
+	// are let through.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of probe requests that must succeed to
+	// close the circuit again.
+	HalfOpenProbes int
+}
+
+// DefaultBreakerConfig returns the circuit breaker configuration used when
+// none is given.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ErrorRate:      DefaultBreakerErrorRate,
+		MinRequests:    DefaultBreakerMinRequests,
+		Window:         DefaultBreakerWindow,
+		OpenDuration:   DefaultBreakerOpenDuration,
+		HalfOpenProbes: DefaultBreakerHalfOpenProbes,
+	}
+}
+
+func (c BreakerConfig) Validate() error {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("circuit breaker error rate must be in [0, 1]")
+	}
+	if c.ErrorRate == 0 {
+		return nil
+	}
+	if c.MinRequests < 1 {
+		return fmt.Errorf("circuit breaker min requests must be at least 1")
+	}
+	if c.Window < breakerBuckets*time.Millisecond {
+		return fmt.Errorf("circuit breaker window must be at least %s", breakerBuckets*time.Millisecond)
+	}
+	if c.OpenDuration <= 0 {
+		return fmt.Errorf("circuit breaker open duration must be positive")
+	}
+	if c.HalfOpenProbes < 1 {
+		return fmt.Errorf("circuit breaker half-open probes must be at least 1")
+	}
+	return nil
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// breaker is a circuit breaker around CubeSigner requests. It opens once the
+// error rate over the window is too high, rejecting requests without sending
+// them, and after a while lets probe requests through to find out whether
+// CubeSigner has recovered. Only failures of CubeSigner itself count:
+// requests it rejects show that it is up.
+type breaker struct {
+	config BreakerConfig
+	clock  Clock
+	log    logging.Logger
+
+	mu       sync.Mutex
+	state    BreakerState
+	buckets  [breakerBuckets]breakerBucket
+	openedAt time.Time
+	// probes in flight and succeeded while half-open
+	probes          int
+	probesSucceeded int
+}
+
+// State returns the current state of the circuit.
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	halfOpened := b.halfOpenIfDue()
+	state := b.state
+	b.mu.Unlock()
+
+	if halfOpened {
+		b.changed(BreakerOpen, BreakerHalfOpen)
+	}
+	return state
+}
+
+// do calls fn unless the circuit is open, and records its outcome.
+func (b *breaker) do(ctx context.Context, fn func(context.Context) error) error {
+	if b.config.ErrorRate == 0 {
+		return fn(ctx)
+	}
+
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	err = fn(ctx)
+	b.record(probe, isUpstreamFailure(ctx, err))
+	return err
+}
+
+// allow returns an error if the request must be rejected, and whether it is a
+// probe.
+func (b *breaker) allow() (bool, error) {
+	b.mu.Lock()
+	halfOpened := b.halfOpenIfDue()
+	defer func() {
+		b.mu.Unlock()
+		if halfOpened {
+			b.changed(BreakerOpen, BreakerHalfOpen)
+		}
+	}()
+
+	switch b.state {
+	case BreakerOpen:
+		return false, errCircuitOpen
+	case BreakerHalfOpen:
+		if b.probes+b.probesSucceeded >= b.config.HalfOpenProbes {
+			return false, errCircuitOpen
+		}
+		b.probes++
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (b *breaker) record(probe bool, failed bool) {
+	b.mu.Lock()
+	previous := b.state
+
+	switch {
+	case probe && b.state == BreakerHalfOpen:
+		b.probes--
+		if failed {
+			b.open()
+		} else if b.probesSucceeded++; b.probesSucceeded >= b.config.HalfOpenProbes {
+			b.state = BreakerClosed
+			b.buckets = [breakerBuckets]breakerBucket{}
+		}
+	case b.state == BreakerClosed:
+		bucket := b.bucket()
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		if requests, failures := b.totals(); requests >= b.config.MinRequests &&
+			float64(failures) >= b.config.ErrorRate*float64(requests) {
+			b.open()
+		}
+	}
+
+	state := b.state
+	b.mu.Unlock()
+	b.changed(previous, state)
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.clock.Now()
+	b.probes = 0
+	b.probesSucceeded = 0
+}
+
+// halfOpenIfDue lets probes through once the circuit has been open for
+// OpenDuration, and returns true if it did. mu must be held.
+func (b *breaker) halfOpenIfDue() bool {
+	if b.state != BreakerOpen || b.clock.Now().Sub(b.openedAt) < b.config.OpenDuration {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	b.probes = 0
+	b.probesSucceeded = 0
+	return true
+}
+
+func (b *breaker) changed(previous, state BreakerState) {
+	if previous == state {
+		return
+	}
+
+	log := b.log.Info
+	if state == BreakerOpen {
+		log = b.log.Warn
+	}
+	log("Circuit breaker state changed", zap.Stringer("from", previous), zap.Stringer("to", state))
+}
+
+// bucket returns the bucket for the current time, resetting it if it holds
+// outcomes from a previous window. mu must be held.
+func (b *breaker) bucket() *breakerBucket {
+	width := int64(b.config.Window / breakerBuckets)
+	index := b.clock.Now().UnixNano() / width
+	start := time.Unix(0, index*width)
+	bucket := &b.buckets[index%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// totals returns the number of requests and failures in the window. mu must be
+// held.
+func (b *breaker) totals() (int, int) {
+	cutoff := b.clock.Now().Add(-b.config.Window)
+	var requests, failures int
+	for _, bucket := range b.buckets {
+		if bucket.start.After(cutoff) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// isUpstreamFailure returns true if a request failed because CubeSigner is
+// failing, rather than because it rejected the request or the caller gave up.
+func isUpstreamFailure(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	// CubeSigner didn't respond before the deadline
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return isTransientError(err)
+}
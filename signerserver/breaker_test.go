@@ -0,0 +1,171 @@
+package signerserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errTestUnavailable = &upstreamError{statusCode: http.StatusServiceUnavailable}
+	errTestRejected    = &upstreamError{statusCode: http.StatusForbidden}
+)
+
+func newTestBreaker(clock Clock) *breaker {
+	return &breaker{
+		config: BreakerConfig{
+			ErrorRate:      0.5,
+			MinRequests:    4,
+			Window:         10 * time.Second,
+			OpenDuration:   5 * time.Second,
+			HalfOpenProbes: 2,
+		},
+		clock: clock,
+		log:   logging.NoLog{},
+	}
+}
+
+func advance(clock *fakeClock, d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// call makes a request through b that fails with err, and returns whether it
+// was let through.
+func call(b *breaker, err error) bool {
+	called := false
+	_ = b.do(context.Background(), func(context.Context) error {
+		called = true
+		return err
+	})
+	return called
+}
+
+func TestBreakerConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultBreakerConfig().Validate())
+	require.NoError(t, BreakerConfig{}.Validate())
+
+	for _, config := range []BreakerConfig{
+		{ErrorRate: 1.5},
+		{ErrorRate: 0.5, MinRequests: 0, Window: time.Second, OpenDuration: time.Second, HalfOpenProbes: 1},
+		{ErrorRate: 0.5, MinRequests: 1, Window: time.Millisecond, OpenDuration: time.Second, HalfOpenProbes: 1},
+		{ErrorRate: 0.5, MinRequests: 1, Window: time.Second, OpenDuration: 0, HalfOpenProbes: 1},
+		{ErrorRate: 0.5, MinRequests: 1, Window: time.Second, OpenDuration: time.Second, HalfOpenProbes: 0},
+	} {
+		require.Error(t, config.Validate(), "%+v", config)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	require := require.New(t)
+	clock := newFakeClock()
+	b := newTestBreaker(clock)
+
+	// not opened below MinRequests, or by requests CubeSigner rejects
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, errTestRejected))
+	require.Equal(BreakerClosed, b.State())
+
+	// opened once half the requests in the window failed
+	require.True(call(b, errTestUnavailable))
+	require.Equal(BreakerOpen, b.State())
+	require.False(call(b, nil))
+	require.ErrorIs(b.do(context.Background(), func(context.Context) error { return nil }), errCircuitOpen)
+
+	// a failed probe opens the circuit again
+	advance(clock, 5*time.Second)
+	require.Equal(BreakerHalfOpen, b.State())
+	require.True(call(b, errTestUnavailable))
+	require.Equal(BreakerOpen, b.State())
+
+	// only HalfOpenProbes requests are let through, and close the circuit
+	// if they succeed
+	advance(clock, 5*time.Second)
+	probe, err := b.allow()
+	require.NoError(err)
+	require.True(probe)
+	require.True(call(b, nil))
+	require.False(call(b, nil))
+	require.Equal(BreakerHalfOpen, b.State())
+	b.record(probe, false)
+	require.Equal(BreakerClosed, b.State())
+
+	// the failures from before the circuit was closed no longer count
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, nil))
+	require.True(call(b, nil))
+	require.True(call(b, nil))
+	require.Equal(BreakerClosed, b.State())
+}
+
+func TestBreakerWindow(t *testing.T) {
+	require := require.New(t)
+	clock := newFakeClock()
+	b := newTestBreaker(clock)
+
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, errTestUnavailable))
+
+	// the failures have left the window
+	advance(clock, 11*time.Second)
+	require.True(call(b, errTestUnavailable))
+	require.True(call(b, nil))
+	require.True(call(b, nil))
+	require.Equal(BreakerClosed, b.State())
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newTestBreaker(newFakeClock())
+	b.config = BreakerConfig{}
+
+	for range 10 {
+		require.True(t, call(b, errTestUnavailable))
+	}
+	require.Equal(t, BreakerClosed, b.State())
+}
+
+func TestSignerServerSignCircuitOpen(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	// requests stop reaching CubeSigner once the circuit opens
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(context.Context, string, string, api.BlobSignRequest, ...api.RequestEditorFn) (*http.Response, error) {
+			return toErrorResponse(t, http.StatusServiceUnavailable, string(api.UnhandledError)), nil
+		}).
+		Times(4)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+	signerServer.breaker = newTestBreaker(newFakeClock())
+
+	for range 4 {
+		_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+		require.Equal(codes.Unavailable, status.Code(err))
+	}
+
+	_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.Equal(codes.Unavailable, status.Code(err))
+	require.ErrorIs(err, errCircuitOpen)
+
+	require.ErrorContains(signerServer.checkBreaker(context.Background()), "circuit breaker is open")
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.breakerState[BreakerOpen]), 0)
+	require.InDelta(0, testutil.ToFloat64(signerServer.metrics.breakerState[BreakerClosed]), 0)
+}
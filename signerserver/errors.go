@@ -0,0 +1,283 @@
+package signerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+const (
+	// errorDomain is the domain of the ErrorInfo attached to CubeSigner
+	// errors.
+	errorDomain = "cubesigner"
+	// invalidSignatureReason is the reason of the ErrorInfo attached to
+	// invalid signatures from CubeSigner.
+	invalidSignatureReason = "INVALID_SIGNATURE"
+)
+
+// staleTokenErrorCodes are the error codes CubeSigner rejects a session token
+// with that refreshing the session can recover from.
+var staleTokenErrorCodes = map[string]bool{
+	string(api.SessionAuthTokenExpired):    true,
+	string(api.SessionInvalidAuthToken):    true,
+	string(api.SessionChanged):             true,
+	string(api.AuthorizationHeaderMissing): true,
+}
+
+// deadSessionErrorCodes are the error codes CubeSigner rejects a session with
+// that refreshing the session can't recover from, and the status they leave
+// the session in.
+var deadSessionErrorCodes = map[string]SessionStatus{
+	string(api.SessionExpired):             SessionExpired,
+	string(api.SessionRefreshTokenExpired): SessionExpired,
+	string(api.SessionRevoked):             SessionRevoked,
+	string(api.SessionNotFound):            SessionRevoked,
+	string(api.SessionInvalidRefreshToken): SessionRevoked,
+	string(api.SessionPossiblyStolenToken): SessionRevoked,
+}
+
+// sessionErrorCodes are the error codes CubeSigner rejects requests with
+// because of a problem with the session, in addition to staleTokenErrorCodes
+// and deadSessionErrorCodes.
+var sessionErrorCodes = map[string]bool{
+	string(api.SessionForWrongOrg):          true,
+	string(api.SessionInvalidEpochToken):    true,
+	string(api.SessionRoleChanged):          true,
+	string(api.SessionWithoutAnyScopeUnder): true,
+	string(api.ImproperSessionScope):        true,
+	string(api.InvalidAuthHeader):           true,
+	string(api.RefreshTokenMissing):         true,
+}
+
+// rateLimitErrorCodes are the error codes CubeSigner rejects requests with
+// when they are rate limited.
+var rateLimitErrorCodes = map[string]bool{
+	string(api.BadRequestErrorCodeTooManyRequests): true,
+	string(api.MfaTotpRateLimit):                   true,
+}
+
+// rejectionErrorCodes are the error codes CubeSigner rejects a request with
+// because of the request itself, in addition to the policy errors it responds
+// to with 403 Forbidden.
+var rejectionErrorCodes = map[string]bool{
+	string(api.BadRequestErrorCodeMessageRejected): true,
+}
+
+// timeoutErrorCodes are the error codes CubeSigner responds with when it timed
+// out serving a request.
+var timeoutErrorCodes = map[string]bool{
+	string(api.PolicyEngineTimeout):        true,
+	string(api.WasmPolicyExecutionTimeout): true,
+}
+
+// upstreamError is returned when CubeSigner responds with an error.
+type upstreamError struct {
+	statusCode int
+	// nil if the error response couldn't be parsed
+	response *api.ErrorResponse
+	// the Retry-After header, if CubeSigner asked to wait before retrying
+	retryAfter string
+}
+
+func newUpstreamError(httpResponse *http.Response, response *api.ErrorResponse) *upstreamError {
+	return &upstreamError{
+		statusCode: httpResponse.StatusCode,
+		response:   response,
+		retryAfter: httpResponse.Header.Get("Retry-After"),
+	}
+}
+
+func (e *upstreamError) Error() string {
+	if e.response == nil {
+		return fmt.Sprintf("unexpected status code: %d", e.statusCode)
+	}
+	return fmt.Sprintf("unexpected status code: %d (%s): %s", e.statusCode, errorCode(e.response), e.response.Message)
+}
+
+// code returns the gRPC code that best describes the error.
+func (e *upstreamError) code() codes.Code {
+	errorCode := errorCode(e.response)
+	_, deadSession := deadSessionErrorCodes[errorCode]
+	switch {
+	case e.statusCode == http.StatusUnauthorized,
+		staleTokenErrorCodes[errorCode],
+		sessionErrorCodes[errorCode],
+		deadSession:
+		return codes.Unauthenticated
+	case e.statusCode == http.StatusTooManyRequests, rateLimitErrorCodes[errorCode]:
+		return codes.ResourceExhausted
+	case rejectionErrorCodes[errorCode]:
+		return codes.PermissionDenied
+	case timeoutErrorCodes[errorCode]:
+		return codes.DeadlineExceeded
+	case e.statusCode >= http.StatusInternalServerError:
+		return codes.Unavailable
+	}
+
+	switch e.statusCode {
+	case http.StatusForbidden:
+		// policy rejections, and the role or key not allowing the request
+		return codes.PermissionDenied
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Unknown
+	}
+}
+
+// details returns the gRPC error details describing the error response.
+func (e *upstreamError) details() []protoadapt.MessageV1 {
+	metadata := map[string]string{
+		"statusCode": strconv.Itoa(e.statusCode),
+	}
+	if e.response != nil {
+		metadata["message"] = e.response.Message
+	}
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason:   errorCode(e.response),
+		Domain:   errorDomain,
+		Metadata: metadata,
+	}}
+	if e.response != nil && e.response.RequestId != nil {
+		details = append(details, &errdetails.RequestInfo{RequestId: *e.response.RequestId})
+	}
+	return details
+}
+
+// invalidSignatureError is returned when CubeSigner responds with a signature
+// that is malformed or doesn't verify against the public key.
+type invalidSignatureError struct {
+	// the signature as returned by CubeSigner
+	signature string
+	reason    string
+}
+
+func (e *invalidSignatureError) Error() string {
+	return "invalid signature from CubeSigner: " + e.reason
+}
+
+// details returns the gRPC error details describing the invalid signature.
+func (e *invalidSignatureError) details() []protoadapt.MessageV1 {
+	return []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason: invalidSignatureReason,
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"reason":    e.reason,
+			"signature": e.signature,
+		},
+	}}
+}
+
+// statusError is an error with the gRPC status it is reported to clients
+// with. It still unwraps to the underlying error, so that it can be inspected
+// when the request is logged.
+type statusError struct {
+	err    error
+	status *status.Status
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func (e *statusError) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// toStatusError returns err with the gRPC status that describes it. Errors
+// from CubeSigner carry the error code, message and request ID as details.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if st, ok := status.FromError(err); ok {
+		return &statusError{err: err, status: st}
+	}
+
+	var (
+		upstreamErr   *upstreamError
+		invalidSigErr *invalidSignatureError
+	)
+	switch {
+	case errors.As(err, &upstreamErr):
+		return newStatusError(err, upstreamErr.code(), upstreamErr.details())
+	case errors.As(err, &invalidSigErr):
+		return newStatusError(err, codes.Internal, invalidSigErr.details())
+	case errors.Is(err, errCircuitOpen):
+		return &statusError{err: err, status: status.New(codes.Unavailable, err.Error())}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &statusError{err: err, status: status.New(codes.DeadlineExceeded, err.Error())}
+	case errors.Is(err, context.Canceled):
+		return &statusError{err: err, status: status.New(codes.Canceled, err.Error())}
+	case isConnectionError(err):
+		return &statusError{err: err, status: status.New(codes.Unavailable, err.Error())}
+	default:
+		return &statusError{err: err, status: status.New(codes.Internal, err.Error())}
+	}
+}
+
+// newStatusError returns err with a gRPC status with code and details.
+func newStatusError(err error, code codes.Code, details []protoadapt.MessageV1) *statusError {
+	st := status.New(code, err.Error())
+	if withDetails, detailsErr := st.WithDetails(details...); detailsErr == nil {
+		st = withDetails
+	}
+	return &statusError{err: err, status: st}
+}
+
+// requestID returns the CubeSigner request ID associated with err, if any.
+func requestID(err error) string {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.response == nil || upstreamErr.response.RequestId == nil {
+		return ""
+	}
+	return *upstreamErr.response.RequestId
+}
+
+// isStaleTokenError returns true if CubeSigner rejected the session token in
+// a way that refreshing the session may fix, e.g. because of clock drift or
+// because the session was refreshed elsewhere.
+func isStaleTokenError(err error) bool {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+	if upstreamErr.statusCode != http.StatusUnauthorized && upstreamErr.statusCode != http.StatusForbidden {
+		return false
+	}
+	return staleTokenErrorCodes[errorCode(upstreamErr.response)]
+}
+
+// deadSessionStatus returns the status of a session that CubeSigner rejected
+// with err, and false if err doesn't mean that the session is unusable.
+func deadSessionStatus(err error) (SessionStatus, bool) {
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) {
+		return SessionValid, false
+	}
+	if upstreamErr.statusCode != http.StatusUnauthorized && upstreamErr.statusCode != http.StatusForbidden {
+		return SessionValid, false
+	}
+	status, ok := deadSessionErrorCodes[errorCode(upstreamErr.response)]
+	return status, ok
+}
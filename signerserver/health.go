@@ -0,0 +1,161 @@
+package signerserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alexliesenfeld/health"
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// upstreamCheckInterval is how often CubeSigner reachability is checked. The
+// check runs in the background so that health probes never hit the CubeSigner
+// API directly.
+const upstreamCheckInterval = 30 * time.Second
+
+// signerServiceName is the service name the signer readiness is reported
+// under by the gRPC health service.
+var signerServiceName = signer.Signer_ServiceDesc.ServiceName
+
+// HealthChecks returns the checks of the key, whose names are prefixed with
+// its key ID. They report the status of the signer session, whether it has
+// been saved and the expiry of its tokens, the reachability of the CubeSigner
+// API, the state of the circuit breaker and the resolution of the public key.
+func (s *SignerServer) HealthChecks() []health.CheckerOption {
+	return []health.CheckerOption{
+		health.WithCheck(health.Check{
+			Name:  s.checkName("session"),
+			Check: s.checkSession,
+		}),
+		health.WithCheck(health.Check{
+			Name:  s.checkName("session-token"),
+			Check: s.checkSessionToken,
+		}),
+		health.WithCheck(health.Check{
+			Name:  s.checkName("refresh-token"),
+			Check: s.checkRefreshToken,
+		}),
+		health.WithCheck(health.Check{
+			Name:  s.checkName("session-saved"),
+			Check: s.checkSessionSaved,
+		}),
+		health.WithPeriodicCheck(upstreamCheckInterval, 0, health.Check{
+			Name:  s.checkName("cubesigner"),
+			Check: s.checkUpstream,
+		}),
+		health.WithCheck(health.Check{
+			Name:  s.checkName("circuit-breaker"),
+			Check: s.checkBreaker,
+		}),
+		health.WithCheck(health.Check{
+			Name:  s.checkName("public-key"),
+			Check: s.checkPublicKey,
+		}),
+	}
+}
+
+func (s *SignerServer) checkName(name string) string {
+	return s.KeyID + "/" + name
+}
+
+// checkSession fails once the session has expired or been revoked. A session
+// whose refreshes are failing is still usable until its token expires, which
+// checkSessionToken reports.
+func (s *SignerServer) checkSession(context.Context) error {
+	if status := s.session.Status(); !status.Usable() {
+		return fmt.Errorf("session is %s, a new session token is required", status)
+	}
+	return nil
+}
+
+func (s *SignerServer) checkSessionToken(context.Context) error {
+	state := s.session.State()
+	if !state.HasToken {
+		return fmt.Errorf("no session token loaded")
+	}
+
+	if s.clock.Now().After(state.AuthTokenExp) {
+		return fmt.Errorf("session token expired at %v", state.AuthTokenExp)
+	}
+	return nil
+}
+
+func (s *SignerServer) checkRefreshToken(context.Context) error {
+	expiryTime := s.session.State().RefreshTokenExp
+	remaining := expiryTime.Sub(s.clock.Now())
+	if remaining < 0 {
+		return fmt.Errorf("refresh token expired at %v", expiryTime)
+	}
+	if remaining < s.refreshConfig.ExpiryWarning {
+		return fmt.Errorf("refresh token expires in %s", remaining.Round(time.Second))
+	}
+	return nil
+}
+
+// checkSessionSaved fails while a refreshed session couldn't be saved to the
+// token store, in which case it is lost if the sidecar restarts.
+func (s *SignerServer) checkSessionSaved(context.Context) error {
+	if s.session.Unsaved() {
+		return fmt.Errorf("session has not been saved to %s", s.session.store)
+	}
+	return nil
+}
+
+// checkUpstream verifies that the key can be fetched from CubeSigner. As a
+// side effect the public key is cached if it hasn't been resolved yet. The
+// check is a single request that isn't retried, and doesn't count towards the
+// circuit breaker, which only reflects signing and public key requests.
+func (s *SignerServer) checkUpstream(ctx context.Context) error {
+	publicKey, err := s.getKey(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reach CubeSigner: %w", err)
+	}
+	s.cachePublicKey(publicKey)
+	return nil
+}
+
+// checkBreaker fails while requests to CubeSigner are rejected, or only let
+// through to probe whether it has recovered.
+func (s *SignerServer) checkBreaker(context.Context) error {
+	if state := s.breaker.State(); state != BreakerClosed {
+		return fmt.Errorf("circuit breaker is %s, CubeSigner is failing", state)
+	}
+	return nil
+}
+
+func (s *SignerServer) checkPublicKey(context.Context) error {
+	if s.cachedPublicKey() == nil {
+		return fmt.Errorf("public key has not been resolved")
+	}
+	return nil
+}
+
+// SetHealthServer sets the gRPC health server that the readiness of the
+// signer service is reported to. The signer service is NOT_SERVING until the
+// session is valid and the public key has been resolved, and goes back to
+// NOT_SERVING once the session can no longer be refreshed.
+func (s *SignerServer) SetHealthServer(healthServer *grpchealth.Server) {
+	s.healthServer = healthServer
+	s.updateServingStatus()
+}
+
+func (s *SignerServer) updateServingStatus() {
+	if s.healthServer == nil {
+		return
+	}
+
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if s.ready() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	s.healthServer.SetServingStatus(signerServiceName, status)
+}
+
+func (s *SignerServer) ready() bool {
+	return s.checkSession(context.Background()) == nil &&
+		s.checkSessionToken(context.Background()) == nil &&
+		s.checkPublicKey(context.Background()) == nil
+}
@@ -0,0 +1,219 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestSignerServerSessionHealthChecks(t *testing.T) {
+	// the checks use the server's clock, which is far from the real time
+	clock := newFakeClock()
+	clock.now = clock.now.Add(48 * time.Hour)
+	now := clock.Now()
+
+	tests := []struct {
+		name            string
+		authTokenExp    time.Time
+		refreshTokenExp time.Time
+		// defaults to DefaultRefreshExpiryWarning
+		expiryWarning time.Duration
+		sessionErr    bool
+		refreshErr    bool
+	}{
+		{
+			name:            "valid session",
+			authTokenExp:    now.Add(time.Minute),
+			refreshTokenExp: now.Add(24 * time.Hour),
+		},
+		{
+			name:            "expired auth token",
+			authTokenExp:    now.Add(-time.Minute),
+			refreshTokenExp: now.Add(24 * time.Hour),
+			sessionErr:      true,
+		},
+		{
+			name:            "refresh token close to expiring",
+			authTokenExp:    now.Add(time.Minute),
+			refreshTokenExp: now.Add(DefaultRefreshExpiryWarning / 2),
+			refreshErr:      true,
+		},
+		{
+			name:            "refresh token expiring after the warning",
+			authTokenExp:    now.Add(time.Minute),
+			refreshTokenExp: now.Add(30 * time.Minute),
+			expiryWarning:   10 * time.Minute,
+		},
+		{
+			name:            "expired refresh token",
+			authTokenExp:    now.Add(-time.Minute),
+			refreshTokenExp: now.Add(-time.Minute),
+			sessionErr:      true,
+			refreshErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			tokenData := &tokenData{
+				NewSessionResponse: api.NewSessionResponse{
+					Token: "test-token",
+					SessionInfo: api.ClientSessionInfo{
+						AuthTokenExp:    api.EpochDateTime(tt.authTokenExp.Unix()),
+						RefreshTokenExp: api.EpochDateTime(tt.refreshTokenExp.Unix()),
+					},
+				},
+			}
+			signerServer := createSignerServer(t, nil, tokenData, keyID)
+			signerServer.clock = clock
+			if tt.expiryWarning != 0 {
+				signerServer.refreshConfig.ExpiryWarning = tt.expiryWarning
+			}
+
+			err := signerServer.checkSessionToken(context.Background())
+			if tt.sessionErr {
+				require.Error(err)
+			} else {
+				require.NoError(err)
+			}
+
+			err = signerServer.checkRefreshToken(context.Background())
+			if tt.refreshErr {
+				require.Error(err)
+			} else {
+				require.NoError(err)
+			}
+
+			// as do the expiry metrics
+			require.InDelta(tt.authTokenExp.Sub(now).Seconds(), testutil.ToFloat64(signerServer.metrics.authTokenExpiry), 1)
+			require.InDelta(tt.refreshTokenExp.Sub(now).Seconds(), testutil.ToFloat64(signerServer.metrics.refreshTokenExpiry), 1)
+		})
+	}
+}
+
+func TestSignerServerUpstreamHealthCheck(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	pkBytes := bls.PublicKeyToCompressedBytes(localsigner.PublicKey())
+
+	gomock.InOrder(
+		mockclient.
+			EXPECT().
+			GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(&http.Response{
+				StatusCode: http.StatusBadGateway,
+				Header:     make(http.Header),
+				Body:       http.NoBody,
+			}, nil),
+		mockclient.
+			EXPECT().
+			GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(toJSONResponse(t, &KeyInfo{
+				PublicKey: "0x" + hex.EncodeToString(pkBytes),
+			}), nil),
+	)
+
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+
+	require.Error(signerServer.checkUpstream(context.Background()))
+	require.Error(signerServer.checkPublicKey(context.Background()))
+
+	// a successful upstream check resolves the public key
+	require.NoError(signerServer.checkUpstream(context.Background()))
+	require.NoError(signerServer.checkPublicKey(context.Background()))
+	require.Equal(pkBytes, signerServer.cachedPublicKey())
+}
+
+func TestSignerServerUpstreamHealthCheckSideEffects(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	// every check is a single request
+	mockclient.
+		EXPECT().
+		GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&http.Response{
+			StatusCode: http.StatusBadGateway,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+		}, nil).
+		Times(5)
+
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+	signerServer.retrier.config.MaxAttempts = 3
+	signerServer.breaker.config.MinRequests = 1
+
+	// failed checks don't open the circuit breaker
+	for range 5 {
+		require.Error(signerServer.checkUpstream(context.Background()))
+	}
+	require.Equal(BreakerClosed, signerServer.breaker.State())
+}
+
+func TestSignerServerServingStatus(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	pkBytes := bls.PublicKeyToCompressedBytes(localsigner.PublicKey())
+
+	mockclient.
+		EXPECT().
+		GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &KeyInfo{
+			PublicKey: "0x" + hex.EncodeToString(pkBytes),
+		}), nil)
+
+	tokenData := &tokenData{
+		NewSessionResponse: api.NewSessionResponse{
+			Token: "test-token",
+			SessionInfo: api.ClientSessionInfo{
+				AuthTokenExp:    api.EpochDateTime(time.Now().Add(time.Minute).Unix()),
+				RefreshTokenExp: api.EpochDateTime(time.Now().Add(time.Hour).Unix()),
+			},
+		},
+	}
+	signerServer := createSignerServer(t, mockclient, tokenData, keyID)
+
+	healthServer := grpchealth.NewServer()
+	signerServer.SetHealthServer(healthServer)
+
+	checkStatus := func(expected healthpb.HealthCheckResponse_ServingStatus) {
+		res, err := healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{Service: signerServiceName})
+		require.NoError(err)
+		require.Equal(expected, res.Status)
+	}
+
+	// not ready until the public key is resolved
+	checkStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	_, err = signerServer.PublicKey(context.Background(), &signer.PublicKeyRequest{})
+	require.NoError(err)
+	checkStatus(healthpb.HealthCheckResponse_SERVING)
+
+	signerServer.session.setStatus(SessionRevoked)
+	signerServer.updateServingStatus()
+	checkStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+}
@@ -0,0 +1,189 @@
+package signerserver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/failover"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultHedgeMinDelay = 20 * time.Millisecond
+	DefaultHedgeMaxDelay = time.Second
+
+	// hedgeSamples is the number of recent latencies the hedge delay is
+	// computed from
+	hedgeSamples = 256
+	// hedgeMinSamples is the number of latencies below which MaxDelay is used
+	// as the hedge delay
+	hedgeMinSamples = 20
+
+	hedgeWinnerPrimary = "primary"
+	hedgeWinnerHedge   = "hedge"
+	hedgeWinnerNone    = "none"
+)
+
+// HedgeConfig configures hedged CubeSigner signing requests.
+type HedgeConfig struct {
+	// Percentile is the percentile of recent signing latencies after which a
+	// second, identical request is sent if the first hasn't returned yet, 0
+	// disables hedging.
+	Percentile float64
+	// MinDelay is the shortest wait before sending the second request.
+	MinDelay time.Duration
+	// MaxDelay is the longest wait before sending the second request, and the
+	// wait used until enough latencies have been observed.
+	MaxDelay time.Duration
+}
+
+// DefaultHedgeConfig returns the hedging configuration used when none is
+// given. Hedging is disabled.
+func DefaultHedgeConfig() HedgeConfig {
+	return HedgeConfig{
+		MinDelay: DefaultHedgeMinDelay,
+		MaxDelay: DefaultHedgeMaxDelay,
+	}
+}
+
+func (c HedgeConfig) Validate() error {
+	if c.Percentile < 0 || c.Percentile >= 1 {
+		return fmt.Errorf("hedge percentile must be in [0, 1)")
+	}
+	if c.Percentile == 0 {
+		return nil
+	}
+	if c.MinDelay <= 0 {
+		return fmt.Errorf("hedge min delay must be positive")
+	}
+	if c.MaxDelay < c.MinDelay {
+		return fmt.Errorf("hedge max delay must be at least the min delay")
+	}
+	return nil
+}
+
+type hedgeResult struct {
+	signature []byte
+	err       error
+	hedge     bool
+}
+
+// hedger sends a second, identical signing request when the first is slower
+// than most recent ones, and uses whichever succeeds first. BLS signatures are
+// deterministic, so both requests produce the same signature. The second
+// request goes to another endpoint when several are configured.
+type hedger struct {
+	config  HedgeConfig
+	clock   Clock
+	metrics *metrics
+	log     logging.Logger
+
+	mu sync.Mutex
+	// ring buffer of recent latencies
+	latencies [hedgeSamples]time.Duration
+	next      int
+	count     int
+}
+
+// do calls fn, and calls it again concurrently if it hasn't returned after the
+// hedge delay. The first successful result is returned and the other call is
+// cancelled. If both fail, the error of the first call is returned.
+func (h *hedger) do(ctx context.Context, operation string, fn func(context.Context) ([]byte, error)) ([]byte, error) {
+	if h.config.Percentile == 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered so that the cancelled call doesn't block
+	results := make(chan hedgeResult, 2)
+	send := func(ctx context.Context, hedge bool) {
+		signature, err := fn(ctx)
+		results <- hedgeResult{signature: signature, err: err, hedge: hedge}
+	}
+
+	start := h.clock.Now()
+	go send(ctx, false)
+
+	delay := h.delay()
+	timer := h.clock.NewTimer(delay)
+	defer timer.Stop()
+
+	var (
+		hedged     bool
+		pending    = 1
+		primaryErr error
+	)
+	for {
+		select {
+		case <-timer.C():
+			hedged = true
+			pending++
+			h.log.Debug("Hedging slow CubeSigner request",
+				zap.String("operation", operation),
+				zap.Duration("delay", delay),
+			)
+			go send(failover.WithHedge(ctx), true)
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// the latency of the first call is at least the time elapsed
+				// when the hedge succeeded
+				h.observe(h.clock.Now().Sub(start))
+				if hedged {
+					h.metrics.observeHedge(operation, hedgeWinner(res.hedge))
+				}
+				return res.signature, nil
+			}
+			if !res.hedge {
+				primaryErr = res.err
+			}
+			if !hedged {
+				// failed before the hedge delay, leave retries to the retrier
+				return nil, res.err
+			}
+			if pending == 0 {
+				h.metrics.observeHedge(operation, hedgeWinnerNone)
+				return nil, primaryErr
+			}
+		}
+	}
+}
+
+func hedgeWinner(hedge bool) string {
+	if hedge {
+		return hedgeWinnerHedge
+	}
+	return hedgeWinnerPrimary
+}
+
+// delay returns the configured percentile of recent latencies, clamped to
+// [MinDelay, MaxDelay].
+func (h *hedger) delay() time.Duration {
+	h.mu.Lock()
+	if h.count < hedgeMinSamples {
+		h.mu.Unlock()
+		return h.config.MaxDelay
+	}
+	latencies := slices.Clone(h.latencies[:h.count])
+	h.mu.Unlock()
+
+	slices.Sort(latencies)
+	delay := latencies[int(h.config.Percentile*float64(len(latencies)))]
+	return min(max(delay, h.config.MinDelay), h.config.MaxDelay)
+}
+
+func (h *hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeSamples
+	h.count = min(h.count+1, hedgeSamples)
+}
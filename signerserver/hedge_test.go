@@ -0,0 +1,164 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testHedgeConfig = HedgeConfig{
+	Percentile: 0.9,
+	MinDelay:   time.Millisecond,
+	MaxDelay:   10 * time.Millisecond,
+}
+
+func TestHedgeConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultHedgeConfig().Validate())
+	require.NoError(t, testHedgeConfig.Validate())
+
+	for _, config := range []HedgeConfig{
+		{Percentile: 1, MinDelay: time.Millisecond, MaxDelay: time.Second},
+		{Percentile: -0.5, MinDelay: time.Millisecond, MaxDelay: time.Second},
+		{Percentile: 0.9, MinDelay: 0, MaxDelay: time.Second},
+		{Percentile: 0.9, MinDelay: time.Second, MaxDelay: time.Millisecond},
+	} {
+		require.Error(t, config.Validate(), "%+v", config)
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	require := require.New(t)
+	h := &hedger{config: HedgeConfig{Percentile: 0.9, MinDelay: 5 * time.Millisecond, MaxDelay: 50 * time.Millisecond}}
+
+	// MaxDelay until enough latencies have been observed
+	for i := range hedgeMinSamples - 1 {
+		h.observe(time.Duration(i+1) * time.Millisecond)
+	}
+	require.Equal(50*time.Millisecond, h.delay())
+
+	h.observe(20 * time.Millisecond)
+	require.Equal(19*time.Millisecond, h.delay())
+
+	// clamped to [MinDelay, MaxDelay]
+	for range hedgeSamples {
+		h.observe(time.Millisecond)
+	}
+	require.Equal(5*time.Millisecond, h.delay())
+	for range hedgeSamples {
+		h.observe(time.Minute)
+	}
+	require.Equal(50*time.Millisecond, h.delay())
+}
+
+func TestSignerServerSignHedged(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+
+	// the first request hangs until it is cancelled, and the hedge succeeds
+	var calls atomic.Int32
+	cancelled := make(chan struct{})
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, _ string, _ string, _ api.BlobSignRequest, _ ...api.RequestEditorFn) (*http.Response, error) {
+			if calls.Add(1) == 1 {
+				<-ctx.Done()
+				close(cancelled)
+				return nil, ctx.Err()
+			}
+			return toJSONResponse(t, &api.SignResponse{
+				Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+			}), nil
+		}).
+		Times(2)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
+	signerServer.hedger.config = testHedgeConfig
+
+	res, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.NoError(err)
+	require.Equal(bls.SignatureToBytes(sig), res.Signature)
+	<-cancelled
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.upstreamHedges.WithLabelValues(operationBlobSign, hedgeWinnerHedge)), 0)
+}
+
+func TestSignerServerSignNotHedged(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &api.SignResponse{
+			Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+		}), nil).
+		Times(1)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
+	signerServer.hedger.config = testHedgeConfig
+	signerServer.hedger.config.MaxDelay = time.Minute
+
+	_, err = signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.NoError(err)
+	require.Zero(testutil.CollectAndCount(signerServer.metrics.upstreamHedges))
+}
+
+func TestSignerServerSignHedgeFailed(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	// both requests fail, the first only once the hedge has been sent
+	var calls atomic.Int32
+	hedged := make(chan struct{})
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(context.Context, string, string, api.BlobSignRequest, ...api.RequestEditorFn) (*http.Response, error) {
+			if calls.Add(1) == 1 {
+				<-hedged
+				return toErrorResponse(t, http.StatusServiceUnavailable, string(api.UnhandledError)), nil
+			}
+			close(hedged)
+			return toErrorResponse(t, http.StatusBadGateway, string(api.UnhandledError)), nil
+		}).
+		Times(2)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+	signerServer.hedger.config = testHedgeConfig
+
+	_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.Equal(codes.Unavailable, status.Code(err))
+	// the error of the first request is returned
+	require.ErrorContains(err, "unexpected status code: 503")
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.upstreamHedges.WithLabelValues(operationBlobSign, hedgeWinnerNone)), 0)
+}
@@ -0,0 +1,258 @@
+package signerserver
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "cube_signer_sidecar"
+
+	methodSign                  = "Sign"
+	methodSignProofOfPossession = "SignProofOfPossession"
+	methodPublicKey             = "PublicKey"
+
+	operationBlobSign = "BlobSign"
+	operationGetKey   = "GetKeyInOrg"
+	operationRefresh  = "SignerSessionRefresh"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+
+	// status code label used when no HTTP response was received
+	statusCodeError = "error"
+	// error code label used when the error response couldn't be parsed
+	errorCodeUnknown = "unknown"
+)
+
+type metrics struct {
+	requests           *prometheus.CounterVec
+	requestDuration    *prometheus.HistogramVec
+	upstreamDuration   *prometheus.HistogramVec
+	upstreamErrors     *prometheus.CounterVec
+	upstreamRetries    *prometheus.CounterVec
+	upstreamHedges     *prometheus.CounterVec
+	tokenRefreshes     *prometheus.CounterVec
+	tokenSaves         *prometheus.CounterVec
+	authTokenExpiry    prometheus.GaugeFunc
+	refreshTokenExpiry prometheus.GaugeFunc
+	// one per session status, set to 1 for the current status
+	sessionStatus []prometheus.GaugeFunc
+	// one per circuit breaker state, set to 1 for the current state
+	breakerState []prometheus.GaugeFunc
+}
+
+func newMetrics(registerer prometheus.Registerer, s *SignerServer) (*metrics, error) {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "requests_total",
+				Help:      "Number of signer gRPC requests served, by method and outcome",
+			},
+			[]string{"method", "outcome"},
+		),
+		requestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "request_duration_seconds",
+				Help:      "Latency of signer gRPC requests, by method and outcome",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"method", "outcome"},
+		),
+		upstreamDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "upstream_request_duration_seconds",
+				Help:      "Latency of CubeSigner API requests, by operation and HTTP status code",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"operation", "status_code"},
+		),
+		upstreamErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "upstream_errors_total",
+				Help:      "Number of error responses from the CubeSigner API, by operation and error code",
+			},
+			[]string{"operation", "error_code"},
+		),
+		upstreamRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "upstream_retries_total",
+				Help:      "Number of CubeSigner API requests retried after a transient failure, by operation",
+			},
+			[]string{"operation"},
+		),
+		upstreamHedges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "upstream_hedges_total",
+				Help:      "Number of CubeSigner API requests hedged with a second request, by operation and the request that succeeded first",
+			},
+			[]string{"operation", "winner"},
+		),
+		tokenRefreshes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "token_refreshes_total",
+				Help:      "Number of session token refreshes, by outcome",
+			},
+			[]string{"outcome"},
+		),
+		tokenSaves: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "token_saves_total",
+				Help:      "Number of saves of the session to the token store, by outcome",
+			},
+			[]string{"outcome"},
+		),
+		authTokenExpiry: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "auth_token_expiry_seconds",
+				Help:      "Seconds until the session auth token expires",
+			},
+			func() float64 {
+				return s.session.State().AuthTokenExp.Sub(s.clock.Now()).Seconds()
+			},
+		),
+		refreshTokenExpiry: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "refresh_token_expiry_seconds",
+				Help:      "Seconds until the session refresh token expires",
+			},
+			func() float64 {
+				return s.session.State().RefreshTokenExp.Sub(s.clock.Now()).Seconds()
+			},
+		),
+	}
+
+	for _, status := range sessionStatuses {
+		m.sessionStatus = append(m.sessionStatus, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "session_status",
+				Help:        "Status of the session, 1 for the current status and 0 otherwise",
+				ConstLabels: prometheus.Labels{"status": status.String()},
+			},
+			func() float64 {
+				if s.session.Status() == status {
+					return 1
+				}
+				return 0
+			},
+		))
+	}
+
+	for _, state := range breakerStates {
+		m.breakerState = append(m.breakerState, prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "circuit_breaker_state",
+				Help:        "State of the circuit breaker around CubeSigner requests, 1 for the current state and 0 otherwise",
+				ConstLabels: prometheus.Labels{"state": state.String()},
+			},
+			func() float64 {
+				if s.breaker.State() == state {
+					return 1
+				}
+				return 0
+			},
+		))
+	}
+
+	collectors := []prometheus.Collector{
+		m.requests,
+		m.requestDuration,
+		m.upstreamDuration,
+		m.upstreamErrors,
+		m.upstreamRetries,
+		m.upstreamHedges,
+		m.tokenRefreshes,
+		m.tokenSaves,
+		m.authTokenExpiry,
+		m.refreshTokenExpiry,
+	}
+	for _, c := range m.sessionStatus {
+		collectors = append(collectors, c)
+	}
+	for _, c := range m.breakerState {
+		collectors = append(collectors, c)
+	}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *metrics) observeRequest(method string, latency time.Duration, err error) {
+	outcome := outcomeOf(err)
+	m.requests.WithLabelValues(method, outcome).Inc()
+	m.requestDuration.WithLabelValues(method, outcome).Observe(latency.Seconds())
+}
+
+// observeUpstream records the latency and status code of a CubeSigner API
+// request. statusCode is 0 if no response was received.
+func (m *metrics) observeUpstream(operation string, start time.Time, statusCode int) {
+	label := statusCodeError
+	if statusCode != 0 {
+		label = strconv.Itoa(statusCode)
+	}
+	m.upstreamDuration.WithLabelValues(operation, label).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeUpstreamError(operation string, errorResponse *api.ErrorResponse) {
+	m.upstreamErrors.WithLabelValues(operation, errorCode(errorResponse)).Inc()
+}
+
+func (m *metrics) observeRetry(operation string) {
+	m.upstreamRetries.WithLabelValues(operation).Inc()
+}
+
+func (m *metrics) observeHedge(operation string, winner string) {
+	m.upstreamHedges.WithLabelValues(operation, winner).Inc()
+}
+
+func (m *metrics) observeTokenRefresh(err error) {
+	m.tokenRefreshes.WithLabelValues(outcomeOf(err)).Inc()
+}
+
+func (m *metrics) observeTokenSave(err error) {
+	m.tokenSaves.WithLabelValues(outcomeOf(err)).Inc()
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// errorCode returns the string value of the error code in errorResponse.
+func errorCode(errorResponse *api.ErrorResponse) string {
+	if errorResponse == nil {
+		return errorCodeUnknown
+	}
+
+	raw, err := errorResponse.ErrorCode.MarshalJSON()
+	if err != nil {
+		return errorCodeUnknown
+	}
+
+	var code string
+	if err := json.Unmarshal(raw, &code); err != nil || code == "" {
+		return errorCodeUnknown
+	}
+	return code
+}
@@ -0,0 +1,113 @@
+package signerserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSignerServerSignFailureMetrics(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toErrorResponse(t, http.StatusForbidden, "SessionExpired"), nil)
+
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+
+	_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.Error(err)
+
+	m := signerServer.metrics
+	require.InDelta(1, testutil.ToFloat64(m.requests.WithLabelValues(methodSign, outcomeFailure)), 0)
+	require.InDelta(0, testutil.ToFloat64(m.requests.WithLabelValues(methodSign, outcomeSuccess)), 0)
+	require.InDelta(1, testutil.ToFloat64(m.upstreamErrors.WithLabelValues(operationBlobSign, "SessionExpired")), 0)
+	require.Equal(1, testutil.CollectAndCount(m.upstreamDuration, "cube_signer_sidecar_upstream_request_duration_seconds"))
+
+	// the session can no longer be used
+	require.InDelta(0, testutil.ToFloat64(m.sessionStatus[SessionValid]), 0)
+	require.InDelta(1, testutil.ToFloat64(m.sessionStatus[SessionExpired]), 0)
+}
+
+func TestErrorCode(t *testing.T) {
+	require := require.New(t)
+
+	var errorResponse api.ErrorResponse
+	require.NoError(json.Unmarshal([]byte(`{"error_code":"MessageRejected","message":"rejected"}`), &errorResponse))
+	require.Equal("MessageRejected", errorCode(&errorResponse))
+
+	require.Equal(errorCodeUnknown, errorCode(nil))
+	require.Equal(errorCodeUnknown, errorCode(&api.ErrorResponse{}))
+}
+
+func toErrorResponse(t *testing.T, statusCode int, code string) *http.Response {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"error_code": code,
+		"message":    "test error",
+		"request_id": "test-request-id",
+	})
+	require.NoError(t, err)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestSignerServerLogsMessageHash(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toErrorResponse(t, http.StatusForbidden, "SessionExpired"), nil)
+
+	var logs bytes.Buffer
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+	signerServer.log = logging.NewLogger("", logging.NewWrappedCore(logging.Debug, nopCloser{&logs}, logging.JSON.ConsoleEncoder()))
+
+	msg := []byte("test-message")
+	_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: msg})
+	require.Error(err)
+
+	msgHash := sha256.Sum256(msg)
+	require.Contains(logs.String(), `"method":"Sign"`)
+	require.Contains(logs.String(), `"messageHash":"`+hex.EncodeToString(msgHash[:])+`"`)
+	require.Contains(logs.String(), `"requestID":"test-request-id"`)
+	require.NotContains(logs.String(), hex.EncodeToString(msg))
+	require.NotContains(logs.String(), base64.StdEncoding.EncodeToString(msg))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
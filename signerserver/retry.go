@@ -0,0 +1,222 @@
+package signerserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 2 * time.Second
+)
+
+// RetryConfig configures how CubeSigner requests that fail transiently are
+// retried.
+type RetryConfig struct {
+	// MaxAttempts is the number of times a request is sent, 1 disables
+	// retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, which doubles with
+	// every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries. Requests are not retried if
+	// CubeSigner asks to wait longer than this with Retry-After.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryConfig returns the retry configuration used when none is given.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+	}
+}
+
+func (c RetryConfig) Validate() error {
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("retry max attempts must be at least 1")
+	}
+	if c.InitialBackoff <= 0 {
+		return fmt.Errorf("retry initial backoff must be positive")
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("retry max backoff must be at least the initial backoff")
+	}
+	return nil
+}
+
+// retrier retries CubeSigner requests that failed transiently, backing off
+// exponentially with jitter. Retries never extend past the deadline of the
+// request they are made for.
+type retrier struct {
+	config  RetryConfig
+	clock   Clock
+	metrics *metrics
+	log     logging.Logger
+	// returns a random float in [0, 1)
+	rand func() float64
+}
+
+// do calls fn until it succeeds, fails with an error that retrying won't fix,
+// or the attempts run out. The error of the last attempt is returned.
+func (r *retrier) do(ctx context.Context, operation string, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= r.config.MaxAttempts || ctx.Err() != nil || !isTransientError(err) {
+			return err
+		}
+
+		wait, ok := r.backoff(attempt, err)
+		if !ok {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(r.clock.Now()) <= wait {
+			return err
+		}
+
+		r.metrics.observeRetry(operation)
+		r.log.Debug("Retrying CubeSigner request",
+			zap.String("operation", operation),
+			zap.Int("attempt", attempt),
+			zap.Duration("retryIn", wait),
+			zap.String("requestID", requestID(err)),
+			zap.Error(err),
+		)
+
+		timer := r.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C():
+		}
+	}
+}
+
+// backoff returns the wait before retrying after attempt failed with err: the
+// exponential backoff with the upper half jittered, or the wait CubeSigner
+// asked for if it is longer. Returns false if CubeSigner asked to wait longer
+// than MaxBackoff.
+func (r *retrier) backoff(attempt int, err error) (time.Duration, bool) {
+	backoff := r.config.InitialBackoff
+	for range attempt - 1 {
+		backoff *= 2
+		if backoff >= r.config.MaxBackoff {
+			break
+		}
+	}
+	backoff = min(backoff, r.config.MaxBackoff)
+	backoff = backoff/2 + time.Duration(r.rand()*float64(backoff/2))
+
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) {
+		return backoff, true
+	}
+	retryAfter := parseRetryAfter(upstreamErr.retryAfter, r.clock.Now())
+	if retryAfter <= backoff {
+		return backoff, true
+	}
+	if retryAfter > r.config.MaxBackoff {
+		return 0, false
+	}
+	return retryAfter, true
+}
+
+// isTransientError returns true if a request that failed with err may succeed
+// if it is sent again: CubeSigner was unavailable, rate limited the request,
+// or the connection failed. Requests CubeSigner rejected are never retried.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		code := errorCode(upstreamErr.response)
+		switch {
+		case rejectionErrorCodes[code]:
+			return false
+		case rateLimitErrorCodes[code], timeoutErrorCodes[code]:
+			return true
+		}
+		switch upstreamErr.statusCode {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+
+	return isConnectionError(err)
+}
+
+// isConnectionError returns true if err is a failure to connect to CubeSigner
+// or of the connection to it, as opposed to a request that could never be
+// sent, such as to an invalid URL or to a server whose certificate isn't
+// trusted.
+func isConnectionError(err error) bool {
+	// the HTTP client wraps every error in a *url.Error, which is a net.Error
+	// whatever the cause
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var (
+		certErr        *tls.CertificateVerificationError
+		recordErr      tls.RecordHeaderError
+		alertErr       tls.AlertError
+		authorityErr   x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		certInvalidErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &certErr),
+		errors.As(err, &recordErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &certInvalidErr):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// the connection was closed before the response was read
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter returns the wait requested by the value of a Retry-After
+// header, which is either a number of seconds or an HTTP date, or 0 if there
+// is none.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,250 @@
+package signerserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestRetryConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultRetryConfig().Validate())
+
+	for _, config := range []RetryConfig{
+		{MaxAttempts: 0, InitialBackoff: time.Second, MaxBackoff: time.Second},
+		{MaxAttempts: 3, InitialBackoff: 0, MaxBackoff: time.Second},
+		{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Millisecond},
+	} {
+		require.Error(t, config.Validate(), "%+v", config)
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	require := require.New(t)
+
+	clock := newFakeClock()
+	r := &retrier{
+		config: RetryConfig{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second},
+		clock:  clock,
+		rand:   func() float64 { return 0 },
+	}
+	unavailable := &upstreamError{statusCode: http.StatusServiceUnavailable}
+
+	// the upper half of the backoff is jittered
+	for attempt, expected := range []time.Duration{50, 100, 200, 400, 800, 1000, 1000} {
+		wait, ok := r.backoff(attempt+1, unavailable)
+		require.True(ok)
+		require.Equal(expected*time.Millisecond, wait, "attempt %d", attempt+1)
+	}
+	r.rand = func() float64 { return 0.5 }
+	wait, _ := r.backoff(1, unavailable)
+	require.Equal(75*time.Millisecond, wait)
+
+	// Retry-After is honored if it is longer than the backoff
+	wait, ok := r.backoff(1, &upstreamError{statusCode: http.StatusTooManyRequests, retryAfter: "1"})
+	require.True(ok)
+	require.Equal(time.Second, wait)
+
+	// dates are relative to the retrier's clock
+	retryAt := clock.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+	wait, ok = r.backoff(1, &upstreamError{statusCode: http.StatusTooManyRequests, retryAfter: retryAt})
+	require.True(ok)
+	require.Equal(2*time.Second, wait)
+
+	// unless it is longer than the max backoff
+	_, ok = r.backoff(1, &upstreamError{statusCode: http.StatusTooManyRequests, retryAfter: "60"})
+	require.False(ok)
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{
+			name:      "server error",
+			err:       &upstreamError{statusCode: http.StatusBadGateway},
+			transient: true,
+		},
+		{
+			name:      "rate limited",
+			err:       &upstreamError{statusCode: http.StatusTooManyRequests},
+			transient: true,
+		},
+		{
+			name:      "rate limited error code",
+			err:       newTestUpstreamError(t, http.StatusBadRequest, string(api.BadRequestErrorCodeTooManyRequests)),
+			transient: true,
+		},
+		{
+			name:      "connection reset",
+			err:       &url.Error{Op: "Post", URL: "https://example.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}},
+			transient: true,
+		},
+		{
+			name:      "connection closed",
+			err:       &url.Error{Op: "Post", URL: "https://example.com", Err: io.EOF},
+			transient: true,
+		},
+		{
+			name: "untrusted certificate",
+			err:  &url.Error{Op: "Post", URL: "https://example.com", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}},
+		},
+		{
+			name: "unsupported scheme",
+			err:  &url.Error{Op: "Post", URL: "ftp://example.com", Err: errors.New(`unsupported protocol scheme "ftp"`)},
+		},
+		{
+			name: "message rejected",
+			err:  newTestUpstreamError(t, http.StatusBadRequest, string(api.BadRequestErrorCodeMessageRejected)),
+		},
+		{
+			name: "policy rejection",
+			err:  newTestUpstreamError(t, http.StatusForbidden, string(api.RawSigningNotAllowed)),
+		},
+		{
+			name: "not implemented",
+			err:  &upstreamError{statusCode: http.StatusNotImplemented},
+		},
+		{
+			name: "deadline exceeded",
+			err:  &url.Error{Op: "Post", URL: "https://example.com", Err: context.DeadlineExceeded},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.transient, isTransientError(tt.err))
+		})
+	}
+}
+
+func newTestUpstreamError(t *testing.T, statusCode int, code string) *upstreamError {
+	t.Helper()
+	res, err := api.ParseBlobSignResponse(toErrorResponse(t, statusCode, code))
+	require.NoError(t, err)
+	return newUpstreamError(res.HTTPResponse, res.JSONDefault)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+
+	require.Zero(parseRetryAfter("", now))
+	require.Equal(2*time.Second, parseRetryAfter("2", now))
+	require.InDelta(3*time.Second, parseRetryAfter(now.Add(3*time.Second).UTC().Format(http.TimeFormat), now), float64(time.Second))
+	require.Zero(parseRetryAfter("soon", now))
+}
+
+func TestSignerServerSignRetries(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+
+	rateLimited := toErrorResponse(t, http.StatusTooManyRequests, string(api.BadRequestErrorCodeTooManyRequests))
+	rateLimited.Header.Set("Retry-After", "0")
+	gomock.InOrder(
+		mockclient.
+			EXPECT().
+			BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(toErrorResponse(t, http.StatusServiceUnavailable, string(api.UnhandledError)), nil),
+		mockclient.
+			EXPECT().
+			BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(rateLimited, nil),
+		mockclient.
+			EXPECT().
+			BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(toJSONResponse(t, &api.SignResponse{
+				Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+			}), nil),
+	)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
+	signerServer.retrier.config.MaxAttempts = 3
+
+	res, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.NoError(err)
+	require.Equal(bls.SignatureToBytes(sig), res.Signature)
+	require.InDelta(2, testutil.ToFloat64(signerServer.metrics.upstreamRetries.WithLabelValues(operationBlobSign)), 0)
+}
+
+func TestSignerServerSignNotRetried(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		errorCode  string
+		backoff    time.Duration
+		timeout    time.Duration
+	}{
+		{
+			name:       "message rejected",
+			statusCode: http.StatusBadRequest,
+			errorCode:  string(api.BadRequestErrorCodeMessageRejected),
+		},
+		{
+			name:       "backoff past the deadline",
+			statusCode: http.StatusServiceUnavailable,
+			errorCode:  string(api.UnhandledError),
+			backoff:    time.Minute,
+			timeout:    time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			ctrl := gomock.NewController(t)
+			mockclient := mockapi.NewMockClientInterface(ctrl)
+
+			mockclient.
+				EXPECT().
+				BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(toErrorResponse(t, tt.statusCode, tt.errorCode), nil).
+				Times(1)
+
+			signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+			cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+			signerServer.retrier.config.MaxAttempts = 3
+			if tt.backoff != 0 {
+				signerServer.retrier.config.InitialBackoff = tt.backoff
+				signerServer.retrier.config.MaxBackoff = tt.backoff
+			}
+
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			_, err := signerServer.Sign(ctx, &signer.SignRequest{Message: []byte("test-message")})
+			require.Error(err)
+			require.InDelta(0, testutil.ToFloat64(signerServer.metrics.upstreamRetries.WithLabelValues(operationBlobSign)), 0)
+		})
+	}
+}
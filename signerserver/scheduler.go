@@ -0,0 +1,200 @@
+package signerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRefreshMargin     = 0.2
+	DefaultRefreshJitter     = 0.05
+	DefaultRefreshMaxBackoff = time.Minute
+	// DefaultRefreshExpiryWarning leaves an hour to create a new session
+	// before the refresh token expires
+	DefaultRefreshExpiryWarning = time.Hour
+
+	// minRefreshBackoff is the wait after the first failed refresh
+	minRefreshBackoff = time.Second
+)
+
+// RefreshConfig configures when session tokens are refreshed.
+type RefreshConfig struct {
+	// Margin is the fraction of the session token's lifetime left when it is
+	// refreshed, e.g. 0.2 refreshes a 5 minute token after 4 minutes.
+	Margin float64
+	// Jitter is the maximum fraction of the token's lifetime the refresh is
+	// randomly brought forward by, so that sidecars started together don't
+	// refresh in lockstep.
+	Jitter float64
+	// MaxBackoff caps the exponential backoff between failed refreshes.
+	MaxBackoff time.Duration
+	// ExpiryWarning is how long before the refresh token expires that the
+	// sidecar starts reporting itself as unhealthy, leaving time for an
+	// operator to create a new session.
+	ExpiryWarning time.Duration
+}
+
+// DefaultRefreshConfig returns the refresh configuration used when none is
+// given.
+func DefaultRefreshConfig() RefreshConfig {
+	return RefreshConfig{
+		Margin:        DefaultRefreshMargin,
+		Jitter:        DefaultRefreshJitter,
+		MaxBackoff:    DefaultRefreshMaxBackoff,
+		ExpiryWarning: DefaultRefreshExpiryWarning,
+	}
+}
+
+func (c RefreshConfig) Validate() error {
+	if c.Margin < 0 || c.Margin >= 1 {
+		return fmt.Errorf("refresh margin must be in [0, 1)")
+	}
+	if c.Jitter < 0 || c.Margin+c.Jitter >= 1 {
+		return fmt.Errorf("refresh jitter must be positive and less than 1 minus the margin")
+	}
+	if c.MaxBackoff < minRefreshBackoff {
+		return fmt.Errorf("refresh max backoff must be at least %s", minRefreshBackoff)
+	}
+	if c.ExpiryWarning < 0 {
+		return fmt.Errorf("refresh token expiry warning must not be negative")
+	}
+	return nil
+}
+
+// refreshScheduler refreshes the session ahead of the session token expiry,
+// backing off exponentially while refreshes fail. A refreshed session that
+// couldn't be saved is saved again with its own backoff, without refreshing it
+// again. Once the refresh token has expired or the session has been revoked it
+// waits for the session to be replaced, leaving the signer running but not
+// ready.
+type refreshScheduler struct {
+	config  RefreshConfig
+	clock   Clock
+	session *SessionManager
+	refresh func(context.Context) error
+	save    func(context.Context) error
+	log     logging.Logger
+	// returns a random float in [0, 1)
+	rand func() float64
+}
+
+func (r *refreshScheduler) run(ctx context.Context) {
+	failures, saveFailures := 0, 0
+	for {
+		state := r.session.State()
+
+		var wait time.Duration
+		if failures == 0 {
+			wait = r.untilRefresh(state)
+		} else {
+			wait = r.backoff(failures)
+		}
+		saving := r.session.Unsaved() && r.backoff(saveFailures+1) < wait
+		switch {
+		case saving:
+			wait = r.backoff(saveFailures + 1)
+		case failures == 0:
+			r.log.Info("Waiting until refreshing token", zap.Duration("waitDuration", wait))
+		}
+
+		timer := r.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-r.session.replaced:
+			// Reschedule for the new session
+			timer.Stop()
+			failures, saveFailures = 0, 0
+			continue
+		case <-r.session.saveFailed:
+			// Schedule saving the session again
+			timer.Stop()
+			continue
+		case <-timer.C():
+		}
+
+		// Neither a refresh nor a save is abandoned on shutdown, so that the
+		// session a refresh obtains is saved
+		opCtx, cancel := detachRefresh(ctx)
+		if saving {
+			err := r.save(opCtx)
+			cancel()
+			r.drainSaveFailed()
+			if err != nil {
+				saveFailures++
+				r.log.Debug("Saving session again later",
+					zap.Int("failures", saveFailures),
+					zap.Duration("retryIn", r.backoff(saveFailures+1)),
+				)
+			} else {
+				saveFailures = 0
+			}
+			continue
+		}
+
+		err := r.refresh(opCtx)
+		cancel()
+		// a failed save of the new session is already accounted for
+		r.drainSaveFailed()
+		saveFailures = 0
+		switch {
+		case errors.Is(err, errRefreshTokenExpired), errors.Is(err, errSessionRevoked):
+			r.log.Error("Session can no longer be refreshed, a new session token is required",
+				zap.Error(err),
+				zap.String("requestID", requestID(err)),
+				zap.Time("refreshTokenExpiry", state.RefreshTokenExp),
+			)
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.session.replaced:
+				failures = 0
+			}
+		case err != nil:
+			failures++
+			r.log.Warn("Failed to refresh token",
+				zap.Error(err),
+				zap.String("requestID", requestID(err)),
+				zap.Int("failures", failures),
+				zap.Duration("retryIn", r.backoff(failures)),
+			)
+		default:
+			failures = 0
+		}
+	}
+}
+
+// drainSaveFailed clears a save failure signalled by the scheduler's own save.
+func (r *refreshScheduler) drainSaveFailed() {
+	select {
+	case <-r.session.saveFailed:
+	default:
+	}
+}
+
+// untilRefresh returns how long to wait before refreshing the session, which
+// is when Margin plus a random part of Jitter of the token lifetime is left.
+func (r *refreshScheduler) untilRefresh(state SessionState) time.Duration {
+	lifetime := state.AuthTokenExp.Sub(state.IssuedAt)
+	early := r.config.Margin + r.config.Jitter*r.rand()
+	refreshAt := state.AuthTokenExp.Add(-time.Duration(early * float64(lifetime)))
+	return max(refreshAt.Sub(r.clock.Now()), 0)
+}
+
+// backoff returns the wait after failures consecutive failed refreshes.
+func (r *refreshScheduler) backoff(failures int) time.Duration {
+	backoff := minRefreshBackoff
+	for range failures - 1 {
+		backoff *= 2
+		if backoff >= r.config.MaxBackoff {
+			return r.config.MaxBackoff
+		}
+	}
+	return min(backoff, r.config.MaxBackoff)
+}
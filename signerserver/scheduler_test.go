@@ -0,0 +1,400 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when a timer is fired, and hands out every timer it
+// creates so that tests can check the scheduled waits.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan *fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Unix(time.Now().Unix(), 0),
+		timers: make(chan *fakeTimer, 1),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{d: d, c: make(chan time.Time, 1)}
+	c.timers <- t
+	return t
+}
+
+// fire advances the clock to the deadline of t and fires it.
+func (c *fakeClock) fire(t *fakeTimer) {
+	c.mu.Lock()
+	c.now = c.now.Add(t.d)
+	now := c.now
+	c.mu.Unlock()
+	t.c <- now
+}
+
+type fakeTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (*fakeTimer) Stop() bool {
+	return true
+}
+
+func newSessionAt(now time.Time, lifetime time.Duration) *tokenData {
+	return &tokenData{
+		NewSessionResponse: api.NewSessionResponse{
+			Token: "test-token",
+			SessionInfo: api.ClientSessionInfo{
+				SessionId:       fmt.Sprintf("session-%d", now.Unix()),
+				AuthTokenExp:    api.EpochDateTime(now.Add(lifetime).Unix()),
+				RefreshTokenExp: api.EpochDateTime(now.Add(24 * time.Hour).Unix()),
+			},
+		},
+		RawData:  make(rawMessageMap),
+		issuedAt: now,
+	}
+}
+
+func TestRefreshSchedulerUntilRefresh(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		expiry   time.Time
+		rand     float64
+		expected time.Duration
+	}{
+		{
+			name:     "no jitter",
+			issuedAt: now,
+			expiry:   now.Add(10 * time.Minute),
+			expected: 8 * time.Minute,
+		},
+		{
+			name:     "full jitter",
+			issuedAt: now,
+			expiry:   now.Add(10 * time.Minute),
+			rand:     1,
+			expected: 7 * time.Minute,
+		},
+		{
+			name:     "partially elapsed",
+			issuedAt: now.Add(-5 * time.Minute),
+			expiry:   now.Add(5 * time.Minute),
+			expected: 3 * time.Minute,
+		},
+		{
+			name:     "past the margin",
+			issuedAt: now.Add(-9 * time.Minute),
+			expiry:   now.Add(time.Minute),
+			expected: 0,
+		},
+		{
+			name:     "expired",
+			issuedAt: now.Add(-10 * time.Minute),
+			expiry:   now.Add(-time.Minute),
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler := &refreshScheduler{
+				config: RefreshConfig{Margin: 0.2, Jitter: 0.1, MaxBackoff: time.Minute},
+				clock:  clock,
+				rand:   func() float64 { return tt.rand },
+			}
+
+			wait := scheduler.untilRefresh(SessionState{
+				IssuedAt:     tt.issuedAt,
+				AuthTokenExp: tt.expiry,
+			})
+			require.Equal(t, tt.expected, wait)
+		})
+	}
+}
+
+func TestRefreshSchedulerLoadedSession(t *testing.T) {
+	require := require.New(t)
+
+	clock := newFakeClock()
+	scheduler := &refreshScheduler{
+		config: RefreshConfig{Margin: 0.2, Jitter: 0.1, MaxBackoff: time.Minute},
+		clock:  clock,
+		rand:   func() float64 { return 0 },
+	}
+	// a 10 minute session obtained 5 minutes before it is loaded
+	obtained := newSessionAt(clock.Now().Add(-5*time.Minute), 10*time.Minute)
+
+	load := func(data *tokenData) SessionState {
+		bytes, err := json.Marshal(data)
+		require.NoError(err)
+		loaded, err := decodeTokenData(bytes)
+		require.NoError(err)
+		return newSessionManager(loaded, nil, nil, clock, nil, logging.NoLog{}).State()
+	}
+
+	// the time the session was obtained is saved with it, so it is refreshed
+	// with 20% of its full lifetime left
+	require.Equal(3*time.Minute, scheduler.untilRefresh(load(obtained)))
+
+	// without it the lifetime is only known from when the session was
+	// loaded, so it is refreshed later, but still before it expires
+	obtained.issuedAt = time.Time{}
+	require.Equal(4*time.Minute, scheduler.untilRefresh(load(obtained)))
+}
+
+func TestRefreshSchedulerBackoff(t *testing.T) {
+	scheduler := &refreshScheduler{
+		config: RefreshConfig{MaxBackoff: 10 * time.Second},
+	}
+
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, backoff := range expected {
+		require.Equal(t, backoff, scheduler.backoff(i+1))
+	}
+}
+
+func TestRefreshSchedulerRun(t *testing.T) {
+	require := require.New(t)
+
+	clock := newFakeClock()
+	session := newSessionManager(newSessionAt(clock.Now(), 10*time.Minute), nil, nil, clock, nil, logging.NoLog{})
+
+	errUnavailable := errors.New("unavailable")
+	results := []error{errUnavailable, errUnavailable, nil, errRefreshTokenExpired}
+	calls := 0
+
+	scheduler := &refreshScheduler{
+		config:  RefreshConfig{Margin: 0.2, MaxBackoff: time.Minute},
+		clock:   clock,
+		session: session,
+		refresh: func(context.Context) error {
+			err := results[calls]
+			calls++
+			if err == nil {
+				session.current.Store(newSessionAt(clock.Now(), 5*time.Minute))
+			}
+			return err
+		},
+		log:  logging.NoLog{},
+		rand: func() float64 { return 0 },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.run(ctx)
+	}()
+
+	expectedWaits := []time.Duration{
+		8 * time.Minute, // before the first refresh
+		time.Second,     // after the first failure
+		2 * time.Second, // after the second failure
+		4 * time.Minute, // after refreshing to a 5 minute token
+	}
+	for _, expected := range expectedWaits {
+		timer := <-clock.timers
+		require.Equal(expected, timer.d)
+		clock.fire(timer)
+	}
+
+	// once the refresh token has expired, refreshes resume with a new session
+	replaced, err := session.Replace(&tokenData{
+		NewSessionResponse: newSessionAt(clock.Now(), 10*time.Minute).NewSessionResponse,
+		RawData:            make(rawMessageMap),
+	})
+	require.NoError(err)
+	require.True(replaced)
+
+	timer := <-clock.timers
+	require.Equal(8*time.Minute, timer.d)
+	require.Equal(len(results), calls)
+
+	cancel()
+	<-done
+}
+
+// failingStore is a token store whose first saves fail.
+type failingStore struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (*failingStore) Load(context.Context) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *failingStore) Save(context.Context, []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("save failed")
+	}
+	return nil
+}
+
+func (*failingStore) Watch(context.Context, func([]byte) bool) error {
+	return nil
+}
+
+func (*failingStore) String() string {
+	return "failing store"
+}
+
+func TestRefreshSchedulerSaveRetried(t *testing.T) {
+	require := require.New(t)
+
+	clock := newFakeClock()
+	store := &failingStore{failures: 3}
+	session := newSessionManager(newSessionAt(clock.Now(), 10*time.Minute), store, nil, clock, nil, logging.NoLog{})
+
+	refreshes := 0
+	scheduler := &refreshScheduler{
+		config:  RefreshConfig{Margin: 0.2, MaxBackoff: time.Minute},
+		clock:   clock,
+		session: session,
+		refresh: func(ctx context.Context) error {
+			refreshes++
+			session.current.Store(newSessionAt(clock.Now(), 5*time.Minute))
+			session.unsaved.Store(true)
+			_ = session.Save(ctx)
+			return nil
+		},
+		save: session.Save,
+		log:  logging.NoLog{},
+		rand: func() float64 { return 0 },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.run(ctx)
+	}()
+
+	expectedWaits := []time.Duration{
+		8 * time.Minute, // before the first refresh, whose save fails
+		time.Second,     // before saving again
+		2 * time.Second, // after the second failed save
+		4 * time.Second, // after the third failed save
+	}
+	for _, expected := range expectedWaits {
+		timer := <-clock.timers
+		require.Equal(expected, timer.d)
+		clock.fire(timer)
+	}
+
+	// once saved, the next refresh is scheduled for the refreshed session
+	timer := <-clock.timers
+	require.Equal(4*time.Minute-7*time.Second, timer.d)
+	require.False(session.Unsaved())
+	require.Equal(1, refreshes)
+
+	cancel()
+	<-done
+}
+
+func TestRefreshSchedulerStops(t *testing.T) {
+	clock := newFakeClock()
+	session := newSessionManager(newSessionAt(clock.Now(), 10*time.Minute), nil, nil, clock, nil, logging.NoLog{})
+
+	scheduler := &refreshScheduler{
+		config:  DefaultRefreshConfig(),
+		clock:   clock,
+		session: session,
+		refresh: func(context.Context) error {
+			require.FailNow(t, "unexpected refresh")
+			return nil
+		},
+		log:  logging.NoLog{},
+		rand: func() float64 { return 0 },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.run(ctx)
+	}()
+
+	<-clock.timers
+	cancel()
+	<-done
+}
+
+func TestRefreshSchedulerRefreshOutlivesShutdown(t *testing.T) {
+	clock := newFakeClock()
+	session := newSessionManager(newSessionAt(clock.Now(), 10*time.Minute), nil, nil, clock, nil, logging.NoLog{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	refreshErr := make(chan error, 1)
+	scheduler := &refreshScheduler{
+		config:  DefaultRefreshConfig(),
+		clock:   clock,
+		session: session,
+		refresh: func(refreshCtx context.Context) error {
+			// shutting down while refreshing
+			cancel()
+			refreshErr <- refreshCtx.Err()
+			return nil
+		},
+		log:  logging.NoLog{},
+		rand: func() float64 { return 0 },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.run(ctx)
+	}()
+
+	clock.fire(<-clock.timers)
+	require.NoError(t, <-refreshErr)
+	<-done
+}
+
+func TestRefreshConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(DefaultRefreshConfig().Validate())
+	require.Error(RefreshConfig{Margin: 1, MaxBackoff: time.Minute}.Validate())
+	require.Error(RefreshConfig{Margin: 0.5, Jitter: 0.5, MaxBackoff: time.Minute}.Validate())
+	require.Error(RefreshConfig{Margin: 0.2, Jitter: -0.1, MaxBackoff: time.Minute}.Validate())
+	require.Error(RefreshConfig{Margin: 0.2, MaxBackoff: time.Millisecond}.Validate())
+	require.Error(RefreshConfig{Margin: 0.2, MaxBackoff: time.Minute, ExpiryWarning: -time.Hour}.Validate())
+}
@@ -0,0 +1,430 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"go.uber.org/zap"
+)
+
+const (
+	// refreshTimeout bounds a refresh and the save of the session it obtains.
+	refreshTimeout = 30 * time.Second
+	// flushTimeout bounds the save of the session on shutdown.
+	flushTimeout = 10 * time.Second
+)
+
+var (
+	errRefreshTokenExpired = errors.New("refresh token expired, a new session token is required")
+	errSessionRevoked      = errors.New("session revoked, a new session token is required")
+	errEncryptedTokenData  = errors.New("token data is encrypted, a token encryption key is required")
+	errOlderSession        = errors.New("session can't be refreshed for longer than the current one")
+)
+
+// SessionStatus is where a session is in its lifecycle.
+type SessionStatus int32
+
+const (
+	// SessionValid is a session whose last refresh, if any, succeeded
+	SessionValid SessionStatus = iota
+	// SessionRefreshing is a session being refreshed
+	SessionRefreshing
+	// SessionDegraded is a session whose last refresh failed, but which may
+	// still be refreshed
+	SessionDegraded
+	// SessionExpired is a session whose refresh token has expired
+	SessionExpired
+	// SessionRevoked is a session CubeSigner no longer accepts
+	SessionRevoked
+)
+
+// sessionStatuses lists every status, in order.
+var sessionStatuses = []SessionStatus{
+	SessionValid,
+	SessionRefreshing,
+	SessionDegraded,
+	SessionExpired,
+	SessionRevoked,
+}
+
+func (s SessionStatus) String() string {
+	switch s {
+	case SessionValid:
+		return "valid"
+	case SessionRefreshing:
+		return "refreshing"
+	case SessionDegraded:
+		return "degraded"
+	case SessionExpired:
+		return "expired"
+	case SessionRevoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// Usable returns false once the session can't be used to sign until it is
+// replaced by a new session.
+func (s SessionStatus) Usable() bool {
+	return s != SessionExpired && s != SessionRevoked
+}
+
+// err returns the error requests fail with in an unusable status.
+func (s SessionStatus) err() error {
+	switch s {
+	case SessionExpired:
+		return errRefreshTokenExpired
+	case SessionRevoked:
+		return errSessionRevoked
+	default:
+		return nil
+	}
+}
+
+// SessionState is a point in time view of a CubeSigner session.
+type SessionState struct {
+	// HasToken is false if the token file didn't contain a session token
+	HasToken bool
+	// IssuedAt is when the session token was obtained, or when it was loaded
+	// if the token data doesn't record when it was obtained
+	IssuedAt        time.Time
+	AuthTokenExp    time.Time
+	RefreshTokenExp time.Time
+	Status          SessionStatus
+}
+
+// SessionManager owns the CubeSigner session of a key. The token data is
+// never mutated in place: refreshes build a new snapshot and swap it in
+// atomically, so readers always see a consistent session without locking.
+type SessionManager struct {
+	client  *api.ClientWithResponses
+	store   tokenstore.TokenStore
+	clock   Clock
+	metrics *metrics
+	log     logging.Logger
+
+	current atomic.Pointer[tokenData]
+	status  atomic.Int32
+	// set while the current session hasn't been saved to the token store
+	unsaved atomic.Bool
+	// serializes refreshes and writes to the token file
+	mu sync.Mutex
+	// signalled when the session is replaced from outside the process
+	replaced chan struct{}
+	// signalled when the session couldn't be saved
+	saveFailed chan struct{}
+}
+
+func newSessionManager(
+	data *tokenData,
+	store tokenstore.TokenStore,
+	client *api.ClientWithResponses,
+	clock Clock,
+	metrics *metrics,
+	log logging.Logger,
+) *SessionManager {
+	m := &SessionManager{
+		client:     client,
+		store:      store,
+		clock:      clock,
+		metrics:    metrics,
+		log:        log,
+		replaced:   make(chan struct{}, 1),
+		saveFailed: make(chan struct{}, 1),
+	}
+	setIssuedAt(data, clock.Now())
+	m.current.Store(data)
+	return m
+}
+
+// setIssuedAt sets when a loaded session was obtained to now if the token
+// data doesn't record it, as for sessions created with `cs token create`, or
+// if it records a time in the future. The session was obtained before it was
+// loaded, so its lifetime is then underestimated and it is refreshed later
+// than the refresh margin intends, though still before it expires.
+func setIssuedAt(data *tokenData, now time.Time) {
+	if data.issuedAt.IsZero() || data.issuedAt.After(now) {
+		data.issuedAt = now
+	}
+}
+
+// loadTokenData loads the session from store.
+func loadTokenData(ctx context.Context, store tokenstore.TokenStore) (*tokenData, error) {
+	bytes, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token data: %w", err)
+	}
+	return decodeTokenData(bytes)
+}
+
+func decodeTokenData(bytes []byte) (*tokenData, error) {
+	if tokenstore.IsEncrypted(bytes) {
+		return nil, errEncryptedTokenData
+	}
+
+	var data tokenData
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode token data: %w", err)
+	}
+	return &data, nil
+}
+
+// OrgID returns the organization the session belongs to.
+func (m *SessionManager) OrgID() string {
+	return m.current.Load().OrgID
+}
+
+// CurrentToken returns the session token to authorize requests with.
+func (m *SessionManager) CurrentToken() string {
+	return m.current.Load().Token
+}
+
+// State returns the current state of the session.
+func (m *SessionManager) State() SessionState {
+	data := m.current.Load()
+	return SessionState{
+		HasToken:        data.Token != "",
+		IssuedAt:        data.issuedAt,
+		AuthTokenExp:    time.Unix(int64(data.SessionInfo.AuthTokenExp), 0),
+		RefreshTokenExp: time.Unix(int64(data.SessionInfo.RefreshTokenExp), 0),
+		Status:          m.Status(),
+	}
+}
+
+// Unsaved returns true if the current session hasn't been saved to the token
+// store, e.g. because saving it after a refresh failed.
+func (m *SessionManager) Unsaved() bool {
+	return m.unsaved.Load()
+}
+
+// Status returns the current status of the session.
+func (m *SessionManager) Status() SessionStatus {
+	return SessionStatus(m.status.Load())
+}
+
+func (m *SessionManager) setStatus(status SessionStatus) {
+	previous := SessionStatus(m.status.Swap(int32(status)))
+	if previous == status {
+		return
+	}
+
+	log := m.log.Info
+	if previous == SessionRefreshing || status == SessionRefreshing {
+		log = m.log.Debug
+	}
+	log("Session status changed", zap.Stringer("from", previous), zap.Stringer("to", status))
+}
+
+// Reject records that CubeSigner rejected the session with err. If the
+// session can't be recovered by refreshing it, it is marked as expired or
+// revoked until it is replaced.
+func (m *SessionManager) Reject(err error) {
+	if status, ok := deadSessionStatus(err); ok {
+		m.setStatus(status)
+	}
+}
+
+// detachRefresh returns a context for a refresh started under ctx that isn't
+// cancelled along with it. CubeSigner rotates the refresh token, so a refresh
+// abandoned after CubeSigner handled it loses the new session before it is
+// saved.
+func detachRefresh(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+}
+
+// withAuthToken returns a request editor authorizing the request with token.
+func withAuthToken(token string) api.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("Authorization", token)
+		return nil
+	}
+}
+
+// Refresh exchanges the refresh token for a new session token. The new session
+// is used right away, and must then be persisted with Save. Concurrent
+// refreshes are serialized, each using the session left by the previous one.
+func (m *SessionManager) Refresh(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refresh(ctx)
+}
+
+// RefreshIfCurrent refreshes the session if token is still the current
+// session token. Callers that saw the same token rejected wait for a single
+// refresh instead of each refreshing in turn. Returns true if this call
+// refreshed the session.
+func (m *SessionManager) RefreshIfCurrent(ctx context.Context, token string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.CurrentToken() != token {
+		return false, nil
+	}
+	return true, m.refresh(ctx)
+}
+
+func (m *SessionManager) refresh(ctx context.Context) error {
+	if err := m.Status().err(); err != nil {
+		return err
+	}
+
+	data := m.current.Load()
+	if m.clock.Now().After(time.Unix(int64(data.SessionInfo.RefreshTokenExp), 0)) {
+		m.setStatus(SessionExpired)
+		return errRefreshTokenExpired
+	}
+
+	m.setStatus(SessionRefreshing)
+	start := m.clock.Now()
+	res, err := m.client.SignerSessionRefreshWithResponse(ctx, data.OrgID, *data.toAuthData(), withAuthToken(data.Token))
+	if err != nil {
+		m.metrics.observeUpstream(operationRefresh, start, 0)
+		m.setStatus(SessionDegraded)
+		return fmt.Errorf("failed to refresh session: %w", err)
+	}
+	m.metrics.observeUpstream(operationRefresh, start, res.StatusCode())
+
+	if res.JSON200 == nil {
+		m.metrics.observeUpstreamError(operationRefresh, res.JSONDefault)
+		err := newUpstreamError(res.HTTPResponse, res.JSONDefault)
+		if status, ok := deadSessionStatus(err); ok {
+			m.setStatus(status)
+			return fmt.Errorf("failed to refresh session: %w: %w", status.err(), err)
+		}
+		m.setStatus(SessionDegraded)
+		return fmt.Errorf("failed to refresh session: %w", err)
+	}
+
+	// CubeSigner has rotated the refresh token, so the new session is the only
+	// usable one even if it can't be persisted
+	m.current.Store(&tokenData{
+		NewSessionResponse: *res.JSON200,
+		ID:                 data.ID,
+		RawData:            data.RawData,
+		issuedAt:           start,
+	})
+	m.unsaved.Store(true)
+	m.setStatus(SessionValid)
+	return nil
+}
+
+// Replace replaces the session with data if it is a newer, still refreshable
+// session: either a later epoch or a later expiry of the current session, or
+// a different session whose refresh token expires later. Any other session
+// replaces a current session that can no longer be used. Returns true if the
+// session was replaced, and errOlderSession if data is a different session
+// that was rejected.
+func (m *SessionManager) Replace(data *tokenData) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.replace(data)
+}
+
+func (m *SessionManager) replace(data *tokenData) (bool, error) {
+	if data.Token == "" {
+		return false, errors.New("no session token")
+	}
+
+	now := m.clock.Now()
+	if now.After(time.Unix(int64(data.SessionInfo.RefreshTokenExp), 0)) {
+		return false, errRefreshTokenExpired
+	}
+
+	current := m.current.Load()
+	if current.Token != "" && m.Status().Usable() {
+		newInfo, currentInfo := data.SessionInfo, current.SessionInfo
+		switch {
+		case newInfo.SessionId == currentInfo.SessionId:
+			sameEpochLater := newInfo.Epoch == currentInfo.Epoch &&
+				(newInfo.AuthTokenExp > currentInfo.AuthTokenExp || newInfo.RefreshTokenExp > currentInfo.RefreshTokenExp)
+			if newInfo.Epoch < currentInfo.Epoch || (newInfo.Epoch == currentInfo.Epoch && !sameEpochLater) {
+				return false, nil
+			}
+		case newInfo.RefreshTokenExp <= currentInfo.RefreshTokenExp:
+			return false, fmt.Errorf("%w: refresh token expires at %s, current one at %s",
+				errOlderSession,
+				time.Unix(int64(newInfo.RefreshTokenExp), 0).UTC(),
+				time.Unix(int64(currentInfo.RefreshTokenExp), 0).UTC(),
+			)
+		}
+	}
+
+	setIssuedAt(data, now)
+	m.current.Store(data)
+	// the session was loaded from the token store
+	m.unsaved.Store(false)
+	m.setStatus(SessionValid)
+
+	select {
+	case m.replaced <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Save persists the current session to the token store.
+func (m *SessionManager) Save(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.save(ctx); err != nil {
+		m.unsaved.Store(true)
+		select {
+		case m.saveFailed <- struct{}{}:
+		default:
+		}
+		return err
+	}
+	m.unsaved.Store(false)
+	return nil
+}
+
+func (m *SessionManager) save(ctx context.Context) error {
+	data, err := json.Marshal(m.current.Load())
+	if err != nil {
+		return fmt.Errorf("failed to encode token data: %w", err)
+	}
+
+	m.log.Debug("Saving token data", zap.Stringer("store", m.store))
+
+	err = m.store.Save(ctx, data)
+	if !errors.Is(err, tokenstore.ErrConflict) {
+		return err
+	}
+	return m.reconcile(ctx, data)
+}
+
+// reconcile resolves a save of data that conflicted with token data written
+// by someone else. The stored session is adopted if it is newer, otherwise
+// data is saved again over it.
+func (m *SessionManager) reconcile(ctx context.Context, data []byte) error {
+	bytes, err := m.store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reload token data after a conflict: %w", err)
+	}
+
+	if stored, err := decodeTokenData(bytes); err == nil && stored.OrgID == m.OrgID() {
+		replaced, err := m.replace(stored)
+		if err == nil && replaced {
+			m.log.Info("Adopted newer session saved concurrently",
+				zap.Stringer("store", m.store),
+				zap.String("sessionID", stored.SessionInfo.SessionId),
+				zap.Int32("epoch", stored.SessionInfo.Epoch),
+			)
+			return nil
+		}
+	}
+
+	m.log.Debug("Saving token data over an older session", zap.Stringer("store", m.store))
+	return m.store.Save(ctx, data)
+}
@@ -0,0 +1,393 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func newTestTokenData(token string) *tokenData {
+	return &tokenData{
+		NewSessionResponse: api.NewSessionResponse{
+			Token: token,
+			SessionInfo: api.ClientSessionInfo{
+				AuthTokenExp:    api.EpochDateTime(time.Now().Add(time.Minute).Unix()),
+				RefreshTokenExp: api.EpochDateTime(time.Now().Add(time.Hour).Unix()),
+			},
+		},
+		ID:      testTokenData.ID,
+		RawData: make(rawMessageMap),
+	}
+}
+
+// TestSessionManagerConcurrentSignAndRefresh signs under load while the
+// session is refreshed, and must be run with the race detector to be useful.
+func TestSessionManagerConcurrentSignAndRefresh(t *testing.T) {
+	const (
+		numSigners       = 8
+		signsPerSigner   = 50
+		numRefreshes     = 20
+		initialToken     = "token-0"
+		refreshedTokenFn = "token-%d"
+	)
+
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+	sigHex := "0x" + hex.EncodeToString(bls.SignatureToBytes(sig))
+
+	// Every token that has been issued, any other Authorization header is a
+	// torn or stale read.
+	var (
+		issuedMu  sync.Mutex
+		issued    = map[string]bool{initialToken: true}
+		badTokens atomic.Int64
+	)
+	checkAuthorization := func(reqEditor api.RequestEditorFn) {
+		req := newRequest()
+		if err := reqEditor(context.Background(), req); err != nil {
+			badTokens.Add(1)
+			return
+		}
+
+		issuedMu.Lock()
+		defer issuedMu.Unlock()
+		if !issued[req.Header.Get("Authorization")] {
+			badTokens.Add(1)
+		}
+	}
+
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, _ string, _ api.BlobSignRequest, reqEditor api.RequestEditorFn) (*http.Response, error) {
+			checkAuthorization(reqEditor)
+			return toJSONResponse(t, &api.SignResponse{Signature: sigHex}), nil
+		}).
+		Times(numSigners * signsPerSigner)
+
+	var refreshes atomic.Int64
+	mockclient.
+		EXPECT().
+		SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, _ api.SignerSessionRefreshJSONRequestBody, reqEditor api.RequestEditorFn) (*http.Response, error) {
+			checkAuthorization(reqEditor)
+
+			token := fmt.Sprintf(refreshedTokenFn, refreshes.Add(1))
+			issuedMu.Lock()
+			issued[token] = true
+			issuedMu.Unlock()
+
+			return toJSONResponse(t, &newTestTokenData(token).NewSessionResponse), nil
+		}).
+		Times(numRefreshes)
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(tokenFile, []byte("{}"), 0600))
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData(initialToken), keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
+	signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+
+	var (
+		wg        sync.WaitGroup
+		signErrs  atomic.Int64
+		refreshed = make(chan error, numRefreshes)
+	)
+	for range numSigners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range signsPerSigner {
+				_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+				if err != nil {
+					signErrs.Add(1)
+				}
+				_ = signerServer.checkSessionToken(context.Background())
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range numRefreshes {
+			refreshed <- signerServer.RefreshToken(context.Background())
+		}
+	}()
+	wg.Wait()
+	close(refreshed)
+
+	for err := range refreshed {
+		require.NoError(err)
+	}
+	require.Zero(signErrs.Load())
+	require.Zero(badTokens.Load())
+	require.Equal(fmt.Sprintf(refreshedTokenFn, numRefreshes), signerServer.session.CurrentToken())
+
+	saved, err := loadTokenData(context.Background(), tokenstore.NewFile(tokenFile, logging.NoLog{}))
+	require.NoError(err)
+	require.Equal(signerServer.session.CurrentToken(), saved.Token)
+}
+
+func TestSessionManagerRefreshKeepsSnapshot(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	mockclient.
+		EXPECT().
+		SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toErrorResponse(t, http.StatusServiceUnavailable, "unavailable"), nil)
+
+	data := newTestTokenData("test-token")
+	signerServer := createSignerServer(t, mockclient, data, keyID)
+
+	require.Error(signerServer.RefreshToken(context.Background()))
+
+	// a failed refresh leaves the previous session in place
+	require.Same(data, signerServer.session.current.Load())
+	require.Equal("test-token", signerServer.session.CurrentToken())
+	require.Equal(SessionDegraded, signerServer.session.Status())
+}
+
+func TestSessionManagerRefreshTokenExpired(t *testing.T) {
+	require := require.New(t)
+
+	data := newTestTokenData("test-token")
+	data.SessionInfo.RefreshTokenExp = api.EpochDateTime(time.Now().Add(-time.Minute).Unix())
+
+	// no request is made to CubeSigner
+	signerServer := createSignerServer(t, mockapi.NewMockClientInterface(gomock.NewController(t)), data, keyID)
+
+	require.ErrorIs(signerServer.RefreshToken(context.Background()), errRefreshTokenExpired)
+	require.Equal(SessionExpired, signerServer.session.Status())
+	require.False(signerServer.ready())
+}
+
+func TestSessionManagerRefreshStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		errorCode string
+		expected  SessionStatus
+		err       error
+	}{
+		{
+			name:      "revoked",
+			errorCode: string(api.SessionRevoked),
+			expected:  SessionRevoked,
+			err:       errSessionRevoked,
+		},
+		{
+			name:      "refresh token expired",
+			errorCode: string(api.SessionRefreshTokenExpired),
+			expected:  SessionExpired,
+			err:       errRefreshTokenExpired,
+		},
+		{
+			name:      "transient",
+			errorCode: "InternalError",
+			expected:  SessionDegraded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			ctrl := gomock.NewController(t)
+			mockclient := mockapi.NewMockClientInterface(ctrl)
+
+			mockclient.
+				EXPECT().
+				SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(toErrorResponse(t, http.StatusForbidden, tt.errorCode), nil)
+
+			tokenFile := filepath.Join(t.TempDir(), "token.json")
+			signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+			signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+
+			err := signerServer.RefreshToken(context.Background())
+			require.Error(err)
+			if tt.err != nil {
+				require.ErrorIs(err, tt.err)
+			}
+			require.Equal(tt.expected, signerServer.session.Status())
+
+			// an unusable session isn't refreshed again until it is replaced
+			if !tt.expected.Usable() {
+				require.ErrorIs(signerServer.RefreshToken(context.Background()), tt.err)
+
+				replacement := newTestTokenData("new-token")
+				replacement.SessionInfo.SessionId = "new-session"
+				replaced, err := signerServer.session.Replace(replacement)
+				require.NoError(err)
+				require.True(replaced)
+				require.Equal(SessionValid, signerServer.session.Status())
+			}
+
+			mockclient.
+				EXPECT().
+				SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(toJSONResponse(t, &newTestTokenData("refreshed-token").NewSessionResponse), nil)
+			require.NoError(signerServer.RefreshToken(context.Background()))
+			require.Equal(SessionValid, signerServer.session.Status())
+		})
+	}
+}
+
+func TestLoadEncryptedTokenData(t *testing.T) {
+	require := require.New(t)
+
+	key := make([]byte, tokenstore.KeySize)
+	plaintext, err := json.Marshal(newTestTokenData("test-token"))
+	require.NoError(err)
+	encrypted, err := tokenstore.Encrypt(key, plaintext)
+	require.NoError(err)
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(tokenFile, encrypted, 0600))
+
+	// without the key, the session can't be loaded
+	_, err = loadTokenData(context.Background(), tokenstore.NewFile(tokenFile, logging.NoLog{}))
+	require.ErrorIs(err, errEncryptedTokenData)
+
+	store, err := tokenstore.NewEncrypted(tokenstore.NewFile(tokenFile, logging.NoLog{}), key, logging.NoLog{})
+	require.NoError(err)
+	data, err := loadTokenData(context.Background(), store)
+	require.NoError(err)
+	require.Equal("test-token", data.Token)
+}
+
+// conflictingStore is a token store whose first save conflicts with data
+// written by someone else.
+type conflictingStore struct {
+	mu       sync.Mutex
+	data     []byte
+	conflict bool
+}
+
+func (s *conflictingStore) Load(context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conflict = false
+	return s.data, nil
+}
+
+func (s *conflictingStore) Save(_ context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conflict {
+		return tokenstore.ErrConflict
+	}
+	s.data = data
+	return nil
+}
+
+func (*conflictingStore) Watch(context.Context, func([]byte) bool) error {
+	return nil
+}
+
+func (*conflictingStore) String() string {
+	return "conflicting store"
+}
+
+func TestSessionManagerSaveConflict(t *testing.T) {
+	current := newTestTokenData("current-token")
+	current.SessionInfo.SessionId = "current-session"
+	current.SessionInfo.Epoch = 2
+
+	tests := []struct {
+		name      string
+		sessionID string
+		epoch     int32
+		adopted   bool
+	}{
+		{name: "older epoch", sessionID: "current-session", epoch: 1},
+		{name: "newer epoch", sessionID: "current-session", epoch: 3, adopted: true},
+		{name: "older session", sessionID: "old-session", epoch: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			stored := newTestTokenData("stored-token")
+			stored.SessionInfo.SessionId = tt.sessionID
+			stored.SessionInfo.Epoch = tt.epoch
+			storedBytes, err := json.Marshal(stored)
+			require.NoError(err)
+
+			store := &conflictingStore{data: storedBytes, conflict: true}
+			session := newSessionManager(current, store, nil, realClock{}, nil, logging.NoLog{})
+			require.NoError(session.Save(context.Background()))
+
+			// a newer session saved concurrently is adopted, an older one is
+			// overwritten
+			expectedToken := "current-token"
+			if tt.adopted {
+				expectedToken = "stored-token"
+			}
+			require.Equal(expectedToken, session.CurrentToken())
+
+			saved, err := decodeTokenData(store.data)
+			require.NoError(err)
+			require.Equal(expectedToken, saved.Token)
+		})
+	}
+}
+
+func TestSignerServerRefreshSaveFailed(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	mockclient.
+		EXPECT().
+		SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &newTestTokenData("fresh-token").NewSessionResponse), nil).
+		Times(1)
+
+	// the directory of the token file doesn't exist, so saves fail
+	tokenDir := filepath.Join(t.TempDir(), "tokens")
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	signerServer.session.store = tokenstore.NewFile(filepath.Join(tokenDir, "token.json"), logging.NoLog{})
+
+	// a failed save doesn't fail the refresh
+	require.NoError(signerServer.RefreshToken(context.Background()))
+	require.Equal("fresh-token", signerServer.session.CurrentToken())
+	require.True(signerServer.session.Unsaved())
+	require.Error(signerServer.checkSessionSaved(context.Background()))
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.tokenRefreshes.WithLabelValues(outcomeSuccess)), 0)
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.tokenSaves.WithLabelValues(outcomeFailure)), 0)
+
+	// saving again doesn't refresh again
+	require.NoError(os.Mkdir(tokenDir, 0700))
+	require.NoError(signerServer.saveSession(context.Background()))
+	require.False(signerServer.session.Unsaved())
+	require.NoError(signerServer.checkSessionSaved(context.Background()))
+	require.InDelta(1, testutil.ToFloat64(signerServer.metrics.tokenSaves.WithLabelValues(outcomeSuccess)), 0)
+}
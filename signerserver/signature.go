@@ -0,0 +1,45 @@
+package signerserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+)
+
+// verifySignature parses a signature returned by CubeSigner, a 0x prefixed hex
+// encoded compressed BLS signature, and verifies that it is the signature of
+// msg by publicKey. Proofs of possession are verified with the proof of
+// possession ciphersuite, and other signatures with the signature ciphersuite.
+func verifySignature(signature string, publicKey *bls.PublicKey, msg []byte, proofOfPossession bool) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(signature, "0x")
+	if !ok {
+		return nil, &invalidSignatureError{signature: signature, reason: "missing 0x prefix"}
+	}
+
+	sigBytes, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, &invalidSignatureError{signature: signature, reason: fmt.Sprintf("invalid hex encoding: %s", err)}
+	}
+	if len(sigBytes) != bls.SignatureLen {
+		return nil, &invalidSignatureError{
+			signature: signature,
+			reason:    fmt.Sprintf("%d bytes long, expected %d", len(sigBytes), bls.SignatureLen),
+		}
+	}
+
+	sig, err := bls.SignatureFromBytes(sigBytes)
+	if err != nil {
+		return nil, &invalidSignatureError{signature: signature, reason: fmt.Sprintf("not a compressed BLS signature: %s", err)}
+	}
+
+	verify := bls.Verify
+	if proofOfPossession {
+		verify = bls.VerifyProofOfPossession
+	}
+	if !verify(publicKey, sig, msg) {
+		return nil, &invalidSignatureError{signature: signature, reason: "does not verify against the public key"}
+	}
+	return sigBytes, nil
+}
@@ -0,0 +1,231 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVerifySignature(t *testing.T) {
+	msg := []byte("test-message")
+	localsigner := newTestSigner(t)
+	sig, err := localsigner.Sign(msg)
+	require.NoError(t, err)
+	pop, err := localsigner.SignProofOfPossession(msg)
+	require.NoError(t, err)
+	otherSig, err := newTestSigner(t).Sign(msg)
+	require.NoError(t, err)
+
+	encode := func(sig *bls.Signature) string {
+		return "0x" + hex.EncodeToString(bls.SignatureToBytes(sig))
+	}
+
+	tests := []struct {
+		name              string
+		signature         string
+		proofOfPossession bool
+		reason            string
+	}{
+		{
+			name:      "signature",
+			signature: encode(sig),
+		},
+		{
+			name:              "proof of possession",
+			signature:         encode(pop),
+			proofOfPossession: true,
+		},
+		{
+			name:      "empty",
+			signature: "",
+			reason:    "missing 0x prefix",
+		},
+		{
+			name:      "missing prefix",
+			signature: strings.TrimPrefix(encode(sig), "0x"),
+			reason:    "missing 0x prefix",
+		},
+		{
+			name:      "prefix only",
+			signature: "0x",
+			reason:    "0 bytes long, expected 96",
+		},
+		{
+			name:      "invalid hex",
+			signature: "0xzz",
+			reason:    "invalid hex encoding",
+		},
+		{
+			name:      "truncated",
+			signature: encode(sig)[:len(encode(sig))-2],
+			reason:    "95 bytes long, expected 96",
+		},
+		{
+			name:      "not a point",
+			signature: "0x" + strings.Repeat("ff", bls.SignatureLen),
+			reason:    "not a compressed BLS signature",
+		},
+		{
+			name:      "signed by another key",
+			signature: encode(otherSig),
+			reason:    "does not verify against the public key",
+		},
+		{
+			name:              "signature as proof of possession",
+			signature:         encode(sig),
+			proofOfPossession: true,
+			reason:            "does not verify against the public key",
+		},
+		{
+			name:      "proof of possession as signature",
+			signature: encode(pop),
+			reason:    "does not verify against the public key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			sigBytes, err := verifySignature(tt.signature, localsigner.PublicKey(), msg, tt.proofOfPossession)
+			if tt.reason == "" {
+				require.NoError(err)
+				require.Equal(tt.signature, "0x"+hex.EncodeToString(sigBytes))
+				return
+			}
+
+			var invalidSigErr *invalidSignatureError
+			require.ErrorAs(err, &invalidSigErr)
+			require.Contains(invalidSigErr.reason, tt.reason)
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey := newTestSigner(t).PublicKey()
+	compressed := bls.PublicKeyToCompressedBytes(publicKey)
+
+	tests := []struct {
+		name      string
+		publicKey string
+		err       string
+	}{
+		{name: "valid", publicKey: "0x" + hex.EncodeToString(compressed)},
+		{name: "empty", publicKey: "", err: "missing 0x prefix"},
+		{name: "single character", publicKey: "0", err: "missing 0x prefix"},
+		{name: "missing prefix", publicKey: hex.EncodeToString(compressed), err: "missing 0x prefix"},
+		{name: "invalid hex", publicKey: "0xzz", err: "failed to decode public key"},
+		{name: "truncated", publicKey: "0x" + hex.EncodeToString(compressed[1:]), err: "failed to parse public key"},
+		{name: "not a point", publicKey: "0x" + strings.Repeat("ff", bls.PublicKeyLen), err: "failed to parse public key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			parsed, err := parsePublicKey(tt.publicKey)
+			if tt.err != "" {
+				require.ErrorContains(err, tt.err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(compressed, parsed.compressed)
+			require.Equal(compressed, bls.PublicKeyToCompressedBytes(parsed.key))
+		})
+	}
+}
+
+func TestSignerServerPublicKeyInvalid(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	mockclient.
+		EXPECT().
+		GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &KeyInfo{PublicKey: "0x" + strings.Repeat("ff", bls.PublicKeyLen)}), nil)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+
+	// invalid public keys aren't cached
+	_, err := signerServer.PublicKey(context.Background(), &signer.PublicKeyRequest{})
+	require.ErrorContains(err, "failed to parse public key")
+	require.Nil(signerServer.cachedPublicKey())
+}
+
+func TestSignerServerSignInvalidSignature(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	// signed by another key
+	sig, err := newTestSigner(t).Sign([]byte("test-message"))
+	require.NoError(err)
+	signature := "0x" + hex.EncodeToString(bls.SignatureToBytes(sig))
+
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &api.SignResponse{Signature: signature}), nil).
+		Times(1)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+
+	_, err = signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	st, ok := status.FromError(err)
+	require.True(ok)
+	require.Equal(codes.Internal, st.Code())
+
+	require.Len(st.Details(), 1)
+	errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(ok)
+	require.Equal(invalidSignatureReason, errorInfo.Reason)
+	require.Equal(errorDomain, errorInfo.Domain)
+	require.Equal("does not verify against the public key", errorInfo.Metadata["reason"])
+	require.Equal(signature, errorInfo.Metadata["signature"])
+}
+
+func TestSignerServerSignResolvesPublicKey(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner := newTestSigner(t)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+
+	// the public key is resolved before the first signature is requested
+	gomock.InOrder(
+		mockclient.
+			EXPECT().
+			GetKeyInOrg(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(toJSONResponse(t, &KeyInfo{
+				PublicKey: "0x" + hex.EncodeToString(bls.PublicKeyToCompressedBytes(localsigner.PublicKey())),
+			}), nil),
+		mockclient.
+			EXPECT().
+			BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(toJSONResponse(t, &api.SignResponse{
+				Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+			}), nil),
+	)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+
+	res, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.NoError(err)
+	require.Equal(bls.SignatureToBytes(sig), res.Signature)
+	require.NotNil(signerServer.cachedPublicKey())
+}
@@ -5,163 +5,336 @@ package signerserver
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand/v2"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ava-labs/avalanchego/proto/pb/signer"
 	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/logging"
 	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/status"
 )
 
 var popDst = base64.StdEncoding.EncodeToString(bls.CiphersuiteProofOfPossession.Bytes())
 
 type SignerServer struct {
 	signer.UnimplementedSignerServer
-	OrgID         string
-	KeyID         string
-	client        *api.ClientWithResponses
-	tokenData     *tokenData
-	tokenFilePath string
-	publicKey     []byte
+	OrgID   string
+	KeyID   string
+	client  *api.ClientWithResponses
+	session *SessionManager
+	clock   Clock
+	// refreshConfig configures the background token refresh
+	refreshConfig RefreshConfig
+	retrier       *retrier
+	breaker       *breaker
+	hedger        *hedger
+	publicKey     atomic.Pointer[resolvedPublicKey]
+	healthServer  *grpchealth.Server
+	metrics       *metrics
+	log           logging.Logger
+	// tracks the background token refresh and token file watcher
+	background sync.WaitGroup
 }
 
-func New(keyID string, tokenFilePath string, client *api.ClientWithResponses) (*SignerServer, error) {
-	tokenFile, err := os.Open(tokenFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open token file: %w", err)
+func New(
+	ctx context.Context,
+	keyID string,
+	store tokenstore.TokenStore,
+	client *api.ClientWithResponses,
+	refreshConfig RefreshConfig,
+	retryConfig RetryConfig,
+	breakerConfig BreakerConfig,
+	hedgeConfig HedgeConfig,
+	registerer prometheus.Registerer,
+	log logging.Logger,
+) (*SignerServer, error) {
+	if err := refreshConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := retryConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := breakerConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := hedgeConfig.Validate(); err != nil {
+		return nil, err
 	}
 
-	var tokenData tokenData
-	if err := json.NewDecoder(tokenFile).Decode(&tokenData); err != nil {
-		return nil, fmt.Errorf("failed to decode token data: %w", err)
+	clock := realClock{}
+	tokenData, err := loadTokenData(ctx, store)
+	if err != nil {
+		return nil, err
 	}
 
-	return &SignerServer{
+	s := &SignerServer{
 		OrgID:         tokenData.OrgID,
 		KeyID:         keyID,
 		client:        client,
-		tokenData:     &tokenData,
-		tokenFilePath: tokenFilePath,
-	}, nil
+		clock:         clock,
+		refreshConfig: refreshConfig,
+		log:           log,
+	}
+
+	s.metrics, err = newMetrics(registerer, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	s.session = newSessionManager(tokenData, store, client, clock, s.metrics, log)
+	s.retrier = &retrier{
+		config:  retryConfig,
+		clock:   clock,
+		metrics: s.metrics,
+		log:     log,
+		rand:    rand.Float64,
+	}
+	s.breaker = &breaker{
+		config: breakerConfig,
+		clock:  clock,
+		log:    log,
+	}
+	s.hedger = &hedger{
+		config:  hedgeConfig,
+		clock:   clock,
+		metrics: s.metrics,
+		log:     log,
+	}
+
+	return s, nil
 }
 
 func (s *SignerServer) addAuthHeaderFn() api.RequestEditorFn {
-	return func(ctx context.Context, req *http.Request) error {
-		req.Header.Set("Authorization", s.tokenData.Token)
-		return nil
-	}
+	return withAuthToken(s.session.CurrentToken())
 }
 
-func (s *SignerServer) RefreshToken() error {
-	authData := s.tokenData.toAuthData()
+// RefreshToken refreshes the session and saves the new one to the token store.
+// Only the error of the refresh is returned: a session that can't be saved is
+// still used, and saving it is retried by the background token refresh.
+func (s *SignerServer) RefreshToken(ctx context.Context) error {
+	err := s.session.Refresh(ctx)
+	s.metrics.observeTokenRefresh(err)
+	s.updateServingStatus()
+	if err == nil {
+		_ = s.saveSession(ctx)
+	}
+	return err
+}
 
-	res, err := s.client.SignerSessionRefreshWithResponse(context.Background(), s.OrgID, *authData, s.addAuthHeaderFn())
+// saveSession saves the current session to the token store.
+func (s *SignerServer) saveSession(ctx context.Context) error {
+	err := s.session.Save(ctx)
+	s.metrics.observeTokenSave(err)
 	if err != nil {
-		return fmt.Errorf("failed to refresh session: %w", err)
+		s.log.Warn("Failed to save session",
+			zap.Stringer("store", s.session.store),
+			zap.Error(err),
+		)
 	}
+	return err
+}
 
-	if res.JSON200 == nil {
-		return fmt.Errorf("unexpected status code: %d", res.StatusCode())
+// refreshStaleToken refreshes the session after CubeSigner rejected token,
+// unless a concurrent caller has already done so. The refresh completes even
+// if the request that triggered it is cancelled.
+func (s *SignerServer) refreshStaleToken(ctx context.Context, token string) error {
+	ctx, cancel := detachRefresh(ctx)
+	defer cancel()
+
+	refreshed, err := s.session.RefreshIfCurrent(ctx, token)
+	if refreshed {
+		s.metrics.observeTokenRefresh(err)
+		s.updateServingStatus()
+		if err == nil {
+			_ = s.saveSession(ctx)
+		}
 	}
-
-	s.tokenData.NewSessionResponse = *res.JSON200
-	return s.saveTokenData()
+	return err
 }
 
-func (s *SignerServer) saveTokenData() error {
-	file, err := os.OpenFile(s.tokenFilePath, os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open token file: %w", err)
+// StartBackgroundTokenRefresh refreshes the session in the background until
+// ctx is cancelled or the refresh token expires.
+func (s *SignerServer) StartBackgroundTokenRefresh(ctx context.Context) {
+	scheduler := &refreshScheduler{
+		config:  s.refreshConfig,
+		clock:   s.clock,
+		session: s.session,
+		refresh: s.RefreshToken,
+		save:    s.saveSession,
+		log:     s.log,
+		rand:    rand.Float64,
 	}
-	defer file.Close()
-
-	log.Println("Saving token data")
 
-	return json.NewEncoder(file).Encode(s.tokenData)
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		scheduler.run(ctx)
+	}()
 }
 
-func (s *SignerServer) StartBackgroundTokenRefresh(ctx context.Context) {
+// Close waits for the background token refresh and token store watcher to
+// stop and persists the current token data. The contexts passed to
+// StartBackgroundTokenRefresh and WatchTokenStore must be cancelled before
+// calling Close.
+//
+// The token data is persisted even if ctx has expired, as the shutdown
+// timeout may have been used up by in-flight requests: waiting for the
+// background work and saving are bounded by their own timeouts instead.
+func (s *SignerServer) Close(ctx context.Context) error {
+	stopped := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				expiryTime := time.Unix(int64(s.tokenData.SessionInfo.AuthTokenExp), 0)
-				waitDuration := time.Until(expiryTime) - time.Second
-
-				log.Printf("Waiting %s until refreshing token", waitDuration)
-
-				if waitDuration < 0 {
-					refreshExpiryTime := time.Unix(int64(s.tokenData.SessionInfo.RefreshTokenExp), 0)
-					if time.Until(refreshExpiryTime) < 0 {
-						log.Fatalf("Refresh token expired at %v", refreshExpiryTime)
-					}
-					waitDuration = 0
-				}
-
-				timer := time.NewTimer(waitDuration)
-				select {
-				case <-ctx.Done():
-					timer.Stop()
-					return
-				case <-timer.C:
-					if err := s.RefreshToken(); err != nil {
-						log.Printf("Failed to refresh token: %v", err)
-						continue
-					}
-				}
-			}
-		}
+		s.background.Wait()
+		close(stopped)
 	}()
+
+	// A refresh in progress is bounded by refreshTimeout, and the session it
+	// obtains must not be lost
+	waitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+	defer cancel()
+
+	var errs []error
+	select {
+	case <-stopped:
+	default:
+		select {
+		case <-stopped:
+		case <-waitCtx.Done():
+			errs = append(errs, fmt.Errorf("timed out waiting for token refresh to stop: %w", waitCtx.Err()))
+		}
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+	defer cancel()
+	if err := s.session.Save(flushCtx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
 
-func (s *SignerServer) PublicKey(ctx context.Context, in *signer.PublicKeyRequest) (*signer.PublicKeyResponse, error) {
-	log.Println("Serving pubkey request")
+func (s *SignerServer) PublicKey(ctx context.Context, in *signer.PublicKeyRequest) (res *signer.PublicKeyResponse, err error) {
+	defer func(start time.Time) {
+		s.observeRequest(methodPublicKey, nil, start, err)
+	}(time.Now())
 
-	if s.publicKey != nil {
-		log.Println("Returning cached pubkey")
+	if publicKey := s.cachedPublicKey(); publicKey != nil {
 		publicKeyRes := &signer.PublicKeyResponse{
-			PublicKey: s.publicKey,
+			PublicKey: publicKey,
 		}
 
 		return publicKeyRes, nil
 	}
 
+	publicKey, err := s.fetchPublicKey(ctx)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &signer.PublicKeyResponse{
+		PublicKey: publicKey.compressed,
+	}, nil
+}
+
+// resolvedPublicKey is the BLS public key of the key, both compressed as
+// returned by CubeSigner and parsed to verify signatures with.
+type resolvedPublicKey struct {
+	compressed []byte
+	key        *bls.PublicKey
+}
+
+// fetchPublicKey requests the public key from CubeSigner and caches it.
+func (s *SignerServer) fetchPublicKey(ctx context.Context) (*resolvedPublicKey, error) {
+	var publicKey *resolvedPublicKey
+	err := s.retrier.do(ctx, operationGetKey, func(ctx context.Context) error {
+		return s.breaker.do(ctx, func(ctx context.Context) error {
+			var err error
+			publicKey, err = s.getKey(ctx)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.cachePublicKey(publicKey)
+	return publicKey, nil
+}
+
+// cachePublicKey caches publicKey, logging it only if it differs from the one
+// already cached.
+func (s *SignerServer) cachePublicKey(publicKey *resolvedPublicKey) {
+	previous := s.publicKey.Swap(publicKey)
+	if previous != nil && slices.Equal(previous.compressed, publicKey.compressed) {
+		return
+	}
+
+	s.log.Info("Resolved public key", zap.String("publicKey", hex.EncodeToString(publicKey.compressed)))
+	s.updateServingStatus()
+}
+
+func (s *SignerServer) getKey(ctx context.Context) (*resolvedPublicKey, error) {
+	start := time.Now()
 	rsp, err := s.client.GetKeyInOrg(ctx, s.OrgID, s.KeyID, s.addAuthHeaderFn())
 	if err != nil {
+		s.metrics.observeUpstream(operationGetKey, start, 0)
 		return nil, fmt.Errorf("failed to get key in org: %w", err)
 	}
+	s.metrics.observeUpstream(operationGetKey, start, rsp.StatusCode)
 
 	res, err := parseGetKeyInOrgResponse(rsp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse GetKeyInOrg response: %w", err)
 	}
 
-	if res.JSONDefault != nil {
-		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode())
+	if res.JSON200 == nil {
+		s.metrics.observeUpstreamError(operationGetKey, res.JSONDefault)
+		return nil, fmt.Errorf("failed to get key in org: %w", newUpstreamError(rsp, res.JSONDefault))
 	}
 
-	publicKey, err := hex.DecodeString(res.JSON200.PublicKey[2:])
+	return parsePublicKey(res.JSON200.PublicKey)
+}
+
+// parsePublicKey parses a public key returned by CubeSigner, a 0x prefixed hex
+// encoded compressed BLS public key.
+func parsePublicKey(encoded string) (*resolvedPublicKey, error) {
+	encoded, ok := strings.CutPrefix(encoded, "0x")
+	if !ok {
+		return nil, fmt.Errorf("failed to decode public key: missing 0x prefix")
+	}
+	compressed, err := hex.DecodeString(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode public key: %w", err)
 	}
+	key, err := bls.PublicKeyFromCompressedBytes(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return &resolvedPublicKey{compressed: compressed, key: key}, nil
+}
 
-	log.Println("Public key: ", hex.EncodeToString(publicKey))
-
-	s.publicKey = publicKey
-
-	return &signer.PublicKeyResponse{
-		PublicKey: publicKey,
-	}, nil
+// cachedPublicKey returns the resolved public key, or nil if it hasn't been
+// resolved yet.
+func (s *SignerServer) cachedPublicKey() []byte {
+	if publicKey := s.publicKey.Load(); publicKey != nil {
+		return publicKey.compressed
+	}
+	return nil
 }
 
 type KeyInfo struct {
@@ -211,31 +384,127 @@ func parseGetKeyInOrgResponse(rsp *http.Response) (*GetKeyInOrgResponse, error)
 	return response, nil
 }
 
+// sign signs bytes with the key. If CubeSigner rejects the session token, the
+// session is refreshed and the request retried once. Requests fail without
+// reaching CubeSigner once the session has expired or been revoked. Signatures
+// are verified against the public key before they are returned.
 func (s *SignerServer) sign(ctx context.Context, bytes []byte, blsDst *string) ([]byte, error) {
-	log.Println("Signing: ", hex.EncodeToString(bytes))
+	if err := s.session.Status().err(); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	publicKey, err := s.verificationKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token := s.session.CurrentToken()
+	signature, err := s.blobSign(ctx, bytes, blsDst, publicKey, token)
+	if !isStaleTokenError(err) {
+		s.rejectSession(err)
+		return signature, err
+	}
+
+	s.log.Info("Session token rejected, refreshing the session",
+		zap.Error(err),
+		zap.String("requestID", requestID(err)),
+	)
+	if refreshErr := s.refreshStaleToken(ctx, token); refreshErr != nil {
+		s.log.Warn("Failed to refresh rejected session token",
+			zap.Error(refreshErr),
+			zap.String("requestID", requestID(refreshErr)),
+		)
+		return nil, err
+	}
+
+	signature, err = s.blobSign(ctx, bytes, blsDst, publicKey, s.session.CurrentToken())
+	s.rejectSession(err)
+	return signature, err
+}
 
+// verificationKey returns the public key to verify signatures with, resolving
+// it first if needed.
+func (s *SignerServer) verificationKey(ctx context.Context) (*bls.PublicKey, error) {
+	if publicKey := s.publicKey.Load(); publicKey != nil {
+		return publicKey.key, nil
+	}
+
+	publicKey, err := s.fetchPublicKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the public key to verify signatures with: %w", err)
+	}
+	return publicKey.key, nil
+}
+
+// rejectSession marks the session as expired or revoked if err shows that
+// CubeSigner will no longer accept it.
+func (s *SignerServer) rejectSession(err error) {
+	if err == nil || s.session.Status().err() != nil {
+		return
+	}
+	s.session.Reject(err)
+	if !s.session.Status().Usable() {
+		s.log.Error("CubeSigner rejected the session, a new session token is required",
+			zap.Error(err),
+			zap.String("requestID", requestID(err)),
+		)
+		s.updateServingStatus()
+	}
+}
+
+// blobSign signs bytes with the key using token, retrying transient failures
+// and hedging slow requests. Requests fail without reaching CubeSigner while
+// the circuit breaker is open.
+func (s *SignerServer) blobSign(ctx context.Context, bytes []byte, blsDst *string, publicKey *bls.PublicKey, token string) ([]byte, error) {
+	var signature []byte
+	err := s.retrier.do(ctx, operationBlobSign, func(ctx context.Context) error {
+		return s.breaker.do(ctx, func(ctx context.Context) error {
+			var err error
+			signature, err = s.hedger.do(ctx, operationBlobSign, func(ctx context.Context) ([]byte, error) {
+				return s.sendBlobSign(ctx, bytes, blsDst, publicKey, token)
+			})
+			return err
+		})
+	})
+	return signature, err
+}
+
+func (s *SignerServer) sendBlobSign(ctx context.Context, bytes []byte, blsDst *string, publicKey *bls.PublicKey, token string) ([]byte, error) {
 	msg := base64.StdEncoding.EncodeToString(bytes)
 	blobSignReq := &api.BlobSignRequest{
 		MessageBase64: msg,
 		BlsDst:        blsDst,
 	}
 
-	res, err := s.client.BlobSignWithResponse(ctx, s.OrgID, s.KeyID, *blobSignReq, s.addAuthHeaderFn())
+	start := time.Now()
+	res, err := s.client.BlobSignWithResponse(ctx, s.OrgID, s.KeyID, *blobSignReq, withAuthToken(token))
 	if err != nil {
+		s.metrics.observeUpstream(operationBlobSign, start, 0)
 		return nil, fmt.Errorf("failed to sign blob: %w", err)
 	}
+	s.metrics.observeUpstream(operationBlobSign, start, res.StatusCode())
 
 	if res.JSON200 == nil {
-		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode())
+		s.metrics.observeUpstreamError(operationBlobSign, res.JSONDefault)
+		return nil, fmt.Errorf("failed to sign blob: %w", newUpstreamError(res.HTTPResponse, res.JSONDefault))
 	}
 
-	return hex.DecodeString(res.JSON200.Signature[2:])
+	signature, err := verifySignature(res.JSON200.Signature, publicKey, bytes, blsDst != nil)
+	if err != nil {
+		s.log.Error("CubeSigner returned an invalid signature", zap.Error(err))
+		return nil, err
+	}
+	return signature, nil
 }
 
-func (s *SignerServer) Sign(ctx context.Context, in *signer.SignRequest) (*signer.SignResponse, error) {
+func (s *SignerServer) Sign(ctx context.Context, in *signer.SignRequest) (res *signer.SignResponse, err error) {
+	defer func(start time.Time) {
+		s.observeRequest(methodSign, in.Message, start, err)
+	}(time.Now())
+
 	signature, err := s.sign(ctx, in.Message, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign: %w", err)
+		return nil, toStatusError(fmt.Errorf("failed to sign: %w", err))
 	}
 
 	return &signer.SignResponse{
@@ -243,13 +512,40 @@ func (s *SignerServer) Sign(ctx context.Context, in *signer.SignRequest) (*signe
 	}, nil
 }
 
-func (s *SignerServer) SignProofOfPossession(ctx context.Context, in *signer.SignProofOfPossessionRequest) (*signer.SignProofOfPossessionResponse, error) {
+func (s *SignerServer) SignProofOfPossession(ctx context.Context, in *signer.SignProofOfPossessionRequest) (res *signer.SignProofOfPossessionResponse, err error) {
+	defer func(start time.Time) {
+		s.observeRequest(methodSignProofOfPossession, in.Message, start, err)
+	}(time.Now())
+
 	signature, err := s.sign(ctx, in.Message, &popDst)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign: %w", err)
+		return nil, toStatusError(fmt.Errorf("failed to sign: %w", err))
 	}
 
 	return &signer.SignProofOfPossessionResponse{
 		Signature: signature,
 	}, nil
 }
+
+// observeRequest records the metrics and logs the outcome of a request. Only
+// the hash of the message is logged.
+func (s *SignerServer) observeRequest(method string, msg []byte, start time.Time, err error) {
+	latency := time.Since(start)
+	s.metrics.observeRequest(method, latency, err)
+
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.Duration("latency", latency),
+	}
+	if msg != nil {
+		msgHash := sha256.Sum256(msg)
+		fields = append(fields, zap.String("messageHash", hex.EncodeToString(msgHash[:])))
+	}
+
+	if err != nil {
+		fields = append(fields, zap.String("requestID", requestID(err)), zap.Error(err))
+		s.log.Warn("Failed to serve request", fields...)
+		return
+	}
+	s.log.Debug("Served request", fields...)
+}
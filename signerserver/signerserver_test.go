@@ -5,22 +5,36 @@ package signerserver
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ava-labs/avalanchego/proto/pb/signer"
 	"github.com/ava-labs/avalanchego/utils/crypto/bls"
 	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/avalanchego/utils/logging"
 	"github.com/ava-labs/cube-signer-sidecar/api"
 	"github.com/ava-labs/cube-signer-sidecar/mockapi"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -48,15 +62,12 @@ func TestSignerServerSaveTokenData(t *testing.T) {
 	require.NoError(err)
 	require.NoError(file.Close())
 
-	server := &SignerServer{
-		tokenFilePath: tmpFile,
-		tokenData: &tokenData{
-			ID:      testTokenData.ID,
-			RawData: make(rawMessageMap),
-		},
-	}
+	session := newSessionManager(&tokenData{
+		ID:      testTokenData.ID,
+		RawData: make(rawMessageMap),
+	}, tokenstore.NewFile(tmpFile, logging.NoLog{}), nil, realClock{}, nil, logging.NoLog{})
 
-	require.NoError(server.saveTokenData())
+	require.NoError(session.Save(context.Background()))
 
 	savedData := &tokenData{}
 	file, err = os.Open(tmpFile)
@@ -96,7 +107,7 @@ func TestSignerServerGetPublicKey(t *testing.T) {
 		}).
 		Times(1)
 
-	signerServer := createSignerServer(mockclient, testTokenData, keyID)
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
 
 	res, err := signerServer.PublicKey(context.Background(), &signer.PublicKeyRequest{})
 	require.NoError(err)
@@ -145,7 +156,8 @@ func TestSignerServerSign(t *testing.T) {
 		}).
 		Times(1)
 
-	signerServer := createSignerServer(mockclient, testTokenData, keyID)
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
 	msg := []byte("test-message")
 
 	res, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: msg})
@@ -196,7 +208,8 @@ func TestSignerServerSignProofOfPossession(t *testing.T) {
 		}).
 		Times(1)
 
-	signerServer := createSignerServer(mockclient, testTokenData, keyID)
+	signerServer := createSignerServer(t, mockclient, testTokenData, keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
 	msg := []byte("test-message")
 
 	res, err := signerServer.SignProofOfPossession(context.Background(), &signer.SignProofOfPossessionRequest{Message: msg})
@@ -209,14 +222,55 @@ func TestSignerServerSignProofOfPossession(t *testing.T) {
 	require.True(isValid)
 }
 
-func createSignerServer(mockclient *mockapi.MockClientInterface, tokenData *tokenData, keyID string) *SignerServer {
-	return &SignerServer{
+func createSignerServer(t *testing.T, mockclient *mockapi.MockClientInterface, tokenData *tokenData, keyID string) *SignerServer {
+	t.Helper()
+	client := &api.ClientWithResponses{ClientInterface: mockclient}
+	s := &SignerServer{
 		OrgID:         tokenData.OrgID,
 		KeyID:         keyID,
-		client:        &api.ClientWithResponses{ClientInterface: mockclient},
-		tokenData:     tokenData,
-		tokenFilePath: "",
+		client:        client,
+		clock:         realClock{},
+		refreshConfig: DefaultRefreshConfig(),
+		log:           logging.NoLog{},
 	}
+
+	var err error
+	s.metrics, err = newMetrics(prometheus.NewRegistry(), s)
+	require.NoError(t, err)
+	s.session = newSessionManager(tokenData, nil, client, s.clock, s.metrics, logging.NoLog{})
+	// Retries are enabled by the tests that exercise them
+	s.retrier = &retrier{
+		config:  RetryConfig{MaxAttempts: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		clock:   s.clock,
+		metrics: s.metrics,
+		log:     logging.NoLog{},
+		rand:    func() float64 { return 0 },
+	}
+	s.breaker = &breaker{
+		config: DefaultBreakerConfig(),
+		clock:  s.clock,
+		log:    logging.NoLog{},
+	}
+	s.hedger = &hedger{
+		config:  DefaultHedgeConfig(),
+		clock:   s.clock,
+		metrics: s.metrics,
+		log:     logging.NoLog{},
+	}
+	return s
+}
+
+func newTestSigner(t *testing.T) *localsigner.LocalSigner {
+	t.Helper()
+	signer, err := localsigner.New()
+	require.NoError(t, err)
+	return signer
+}
+
+// cachePublicKey resolves the public key of s to publicKey, so that signing
+// verifies signatures against it without requesting it from CubeSigner.
+func cachePublicKey(s *SignerServer, key *bls.PublicKey) {
+	s.publicKey.Store(&resolvedPublicKey{compressed: bls.PublicKeyToCompressedBytes(key), key: key})
 }
 
 func toJSONResponse(t *testing.T, v any) *http.Response {
@@ -239,3 +293,415 @@ func newRequest() *http.Request {
 		Header: make(http.Header),
 	}
 }
+
+func TestSignerServerClose(t *testing.T) {
+	require := require.New(t)
+
+	tmpFile := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(tmpFile, []byte("{}"), 0600))
+
+	data := &tokenData{
+		NewSessionResponse: api.NewSessionResponse{
+			Token: "test-token",
+			SessionInfo: api.ClientSessionInfo{
+				AuthTokenExp:    api.EpochDateTime(time.Now().Add(time.Hour).Unix()),
+				RefreshTokenExp: api.EpochDateTime(time.Now().Add(24 * time.Hour).Unix()),
+			},
+		},
+		ID:      testTokenData.ID,
+		RawData: make(rawMessageMap),
+	}
+	signerServer := createSignerServer(t, nil, data, keyID)
+	signerServer.session.store = tokenstore.NewFile(tmpFile, logging.NoLog{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signerServer.StartBackgroundTokenRefresh(ctx)
+	cancel()
+
+	require.NoError(signerServer.Close(context.Background()))
+
+	savedData := &tokenData{}
+	file, err := os.ReadFile(tmpFile)
+	require.NoError(err)
+	require.NoError(json.Unmarshal(file, savedData))
+	require.Equal("test-token", savedData.Token)
+}
+
+// contextStore fails saves made with a context that is done, as the
+// Kubernetes and Vault stores do.
+type contextStore struct {
+	conflictingStore
+}
+
+func (s *contextStore) Save(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.conflictingStore.Save(ctx, data)
+}
+
+func TestSignerServerCloseExpiredContext(t *testing.T) {
+	require := require.New(t)
+
+	data := &tokenData{
+		NewSessionResponse: api.NewSessionResponse{
+			Token: "test-token",
+			SessionInfo: api.ClientSessionInfo{
+				AuthTokenExp:    api.EpochDateTime(time.Now().Add(time.Hour).Unix()),
+				RefreshTokenExp: api.EpochDateTime(time.Now().Add(24 * time.Hour).Unix()),
+			},
+		},
+		ID:      testTokenData.ID,
+		RawData: make(rawMessageMap),
+	}
+	signerServer := createSignerServer(t, nil, data, keyID)
+	store := &contextStore{}
+	signerServer.session.store = store
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signerServer.StartBackgroundTokenRefresh(ctx)
+	cancel()
+
+	// the token data is still saved once the shutdown timeout has expired
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	require.NoError(signerServer.Close(expired))
+
+	saved, err := store.Load(context.Background())
+	require.NoError(err)
+	savedData, err := decodeTokenData(saved)
+	require.NoError(err)
+	require.Equal("test-token", savedData.Token)
+}
+
+func TestSignerServerSignRefreshesStaleToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		errorCode  string
+		refreshed  bool
+	}{
+		{
+			name:       "auth token expired",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.SessionAuthTokenExpired),
+			refreshed:  true,
+		},
+		{
+			name:       "invalid auth token",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.SessionInvalidAuthToken),
+			refreshed:  true,
+		},
+		{
+			name:       "missing authorization header",
+			statusCode: http.StatusUnauthorized,
+			errorCode:  string(api.AuthorizationHeaderMissing),
+			refreshed:  true,
+		},
+		{
+			name:       "session revoked",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.SessionRevoked),
+		},
+		{
+			name:       "message rejected",
+			statusCode: http.StatusBadRequest,
+			errorCode:  string(api.BadRequestErrorCodeMessageRejected),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			ctrl := gomock.NewController(t)
+			mockclient := mockapi.NewMockClientInterface(ctrl)
+
+			localsigner, err := localsigner.New()
+			require.NoError(err)
+			sig, err := localsigner.Sign([]byte("test-message"))
+			require.NoError(err)
+
+			blobSign := func(_ context.Context, _ string, _ string, _ api.BlobSignRequest, reqEditor api.RequestEditorFn) (*http.Response, error) {
+				req := newRequest()
+				require.NoError(reqEditor(context.Background(), req))
+				if req.Header.Get("Authorization") == "stale-token" {
+					return toErrorResponse(t, tt.statusCode, tt.errorCode), nil
+				}
+				return toJSONResponse(t, &api.SignResponse{
+					Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+				}), nil
+			}
+
+			if tt.refreshed {
+				mockclient.
+					EXPECT().
+					BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(blobSign).
+					Times(2)
+				mockclient.
+					EXPECT().
+					SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(toJSONResponse(t, &newTestTokenData("fresh-token").NewSessionResponse), nil)
+			} else {
+				mockclient.
+					EXPECT().
+					BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(blobSign)
+			}
+
+			tokenFile := filepath.Join(t.TempDir(), "token.json")
+			require.NoError(os.WriteFile(tokenFile, []byte("{}"), 0600))
+
+			signerServer := createSignerServer(t, mockclient, newTestTokenData("stale-token"), keyID)
+			cachePublicKey(signerServer, localsigner.PublicKey())
+			signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+
+			res, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+			if !tt.refreshed {
+				require.ErrorContains(err, tt.errorCode)
+				require.Equal("stale-token", signerServer.session.CurrentToken())
+				return
+			}
+			require.NoError(err)
+			require.Equal(bls.SignatureToBytes(sig), res.Signature)
+			require.Equal("fresh-token", signerServer.session.CurrentToken())
+		})
+	}
+}
+
+func TestSignerServerSignCoalescesRefresh(t *testing.T) {
+	const numRequests = 10
+
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	localsigner, err := localsigner.New()
+	require.NoError(err)
+	sig, err := localsigner.Sign([]byte("test-message"))
+	require.NoError(err)
+
+	// every request is sent with the stale token before any is retried
+	var stale sync.WaitGroup
+	stale.Add(numRequests)
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, _ string, _ api.BlobSignRequest, reqEditor api.RequestEditorFn) (*http.Response, error) {
+			req := newRequest()
+			if err := reqEditor(context.Background(), req); err != nil {
+				return nil, err
+			}
+			if req.Header.Get("Authorization") == "stale-token" {
+				stale.Done()
+				stale.Wait()
+				return toErrorResponse(t, http.StatusForbidden, string(api.SessionAuthTokenExpired)), nil
+			}
+			return toJSONResponse(t, &api.SignResponse{
+				Signature: "0x" + hex.EncodeToString(bls.SignatureToBytes(sig)),
+			}), nil
+		}).
+		Times(2 * numRequests)
+	mockclient.
+		EXPECT().
+		SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toJSONResponse(t, &newTestTokenData("fresh-token").NewSessionResponse), nil).
+		Times(1)
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(tokenFile, []byte("{}"), 0600))
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("stale-token"), keyID)
+	cachePublicKey(signerServer, localsigner.PublicKey())
+	signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, numRequests)
+	)
+	for range numRequests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(err)
+	}
+}
+
+func TestSignerServerSignRevokedSession(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	// only the first request reaches CubeSigner
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(toErrorResponse(t, http.StatusForbidden, string(api.SessionRevoked)), nil).
+		Times(1)
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+
+	_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.Error(err)
+	require.Equal(SessionRevoked, signerServer.session.Status())
+	require.ErrorContains(signerServer.checkSession(context.Background()), "session is revoked")
+	require.False(signerServer.ready())
+
+	_, err = signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+	require.Equal(codes.Unavailable, status.Code(err))
+	require.ErrorContains(err, "session revoked")
+
+	_, err = signerServer.SignProofOfPossession(context.Background(), &signer.SignProofOfPossessionRequest{Message: []byte("test-message")})
+	require.Equal(codes.Unavailable, status.Code(err))
+}
+
+func TestSignerServerSignErrorStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		errorCode  string
+		err        error
+		expected   codes.Code
+	}{
+		{
+			name:       "policy rejection",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.RawSigningNotAllowed),
+			expected:   codes.PermissionDenied,
+		},
+		{
+			name:       "rate limited",
+			statusCode: http.StatusTooManyRequests,
+			errorCode:  string(api.BadRequestErrorCodeTooManyRequests),
+			expected:   codes.ResourceExhausted,
+		},
+		{
+			name:       "server error",
+			statusCode: http.StatusServiceUnavailable,
+			errorCode:  string(api.UnhandledError),
+			expected:   codes.Unavailable,
+		},
+		{
+			name:       "session for another org",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.SessionForWrongOrg),
+			expected:   codes.Unauthenticated,
+		},
+		{
+			name:       "revoked session",
+			statusCode: http.StatusForbidden,
+			errorCode:  string(api.SessionRevoked),
+			expected:   codes.Unauthenticated,
+		},
+		{
+			name:     "connection refused",
+			err:      &url.Error{Op: "Post", URL: "https://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}},
+			expected: codes.Unavailable,
+		},
+		{
+			name:     "untrusted certificate",
+			err:      &url.Error{Op: "Post", URL: "https://example.com", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}},
+			expected: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			ctrl := gomock.NewController(t)
+			mockclient := mockapi.NewMockClientInterface(ctrl)
+
+			var res *http.Response
+			if tt.err == nil {
+				res = toErrorResponse(t, tt.statusCode, tt.errorCode)
+			}
+			mockclient.
+				EXPECT().
+				BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(res, tt.err)
+
+			signerServer := createSignerServer(t, mockclient, newTestTokenData("test-token"), keyID)
+			cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+
+			_, err := signerServer.Sign(context.Background(), &signer.SignRequest{Message: []byte("test-message")})
+			st, ok := status.FromError(err)
+			require.True(ok)
+			require.Equal(tt.expected, st.Code())
+			if tt.err != nil {
+				require.Empty(st.Details())
+				return
+			}
+
+			// the error response is passed on to the caller
+			require.Len(st.Details(), 2)
+			errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			require.True(ok)
+			require.Equal(tt.errorCode, errorInfo.Reason)
+			require.Equal("test error", errorInfo.Metadata["message"])
+			require.Equal(strconv.Itoa(tt.statusCode), errorInfo.Metadata["statusCode"])
+			requestInfo, ok := st.Details()[1].(*errdetails.RequestInfo)
+			require.True(ok)
+			require.Equal("test-request-id", requestInfo.RequestId)
+
+			// and can still be inspected when logging the request
+			require.Equal("test-request-id", requestID(err))
+		})
+	}
+}
+
+func TestSignerServerSignRefreshOutlivesRequest(t *testing.T) {
+	require := require.New(t)
+	ctrl := gomock.NewController(t)
+	mockclient := mockapi.NewMockClientInterface(ctrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the request is cancelled once the token is rejected, before the
+	// session is refreshed
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(context.Context, string, string, api.BlobSignRequest, ...api.RequestEditorFn) (*http.Response, error) {
+			cancel()
+			return toErrorResponse(t, http.StatusForbidden, string(api.SessionAuthTokenExpired)), nil
+		})
+	mockclient.
+		EXPECT().
+		SignerSessionRefresh(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, _ string, _ api.SignerSessionRefreshJSONRequestBody, _ ...api.RequestEditorFn) (*http.Response, error) {
+			require.NoError(ctx.Err())
+			return toJSONResponse(t, &newTestTokenData("fresh-token").NewSessionResponse), nil
+		})
+	mockclient.
+		EXPECT().
+		BlobSign(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, context.Canceled).
+		AnyTimes()
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(tokenFile, []byte("{}"), 0600))
+
+	signerServer := createSignerServer(t, mockclient, newTestTokenData("stale-token"), keyID)
+	cachePublicKey(signerServer, newTestSigner(t).PublicKey())
+	signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+
+	_, err := signerServer.Sign(ctx, &signer.SignRequest{Message: []byte("test-message")})
+	require.Error(err)
+
+	// the refreshed session is kept and saved
+	require.Equal("fresh-token", signerServer.session.CurrentToken())
+	saved, err := loadTokenData(context.Background(), signerServer.session.store)
+	require.NoError(err)
+	require.Equal("fresh-token", saved.Token)
+}
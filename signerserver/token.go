@@ -2,6 +2,8 @@ package signerserver
 
 import (
 	"encoding/json"
+	"strconv"
+	"time"
 
 	"github.com/ava-labs/cube-signer-sidecar/api"
 )
@@ -11,8 +13,15 @@ type tokenData struct {
 	ID
 	// save the rest of the data so that we don't lose data when overwriting the file
 	RawData rawMessageMap `json:"-"`
+	// when the session was obtained, persisted as issuedAtKey so that the
+	// lifetime of a session is still known once it is loaded again
+	issuedAt time.Time
 }
 
+// issuedAtKey is the key of the time the session was obtained at, in seconds
+// since the UNIX epoch. It isn't part of the session CubeSigner returns.
+const issuedAtKey = "issued_at"
+
 type ID struct {
 	OrgID  string `json:"org_id"`
 	RoleID string `json:"role_id"`
@@ -32,15 +41,25 @@ func (t *tokenData) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
+	// RawData is shared between session snapshots, so it must not be modified
+	rawData := make(rawMessageMap, len(t.RawData))
+	for k, v := range t.RawData {
+		rawData[k] = v
+	}
+
 	for k, v := range sessionResponse {
-		t.RawData[k] = v
+		rawData[k] = v
 	}
 
 	for k, v := range id {
-		t.RawData[k] = v
+		rawData[k] = v
+	}
+
+	if !t.issuedAt.IsZero() {
+		rawData[issuedAtKey] = json.RawMessage(strconv.FormatInt(t.issuedAt.Unix(), 10))
 	}
 
-	return json.Marshal(t.RawData)
+	return json.Marshal(rawData)
 }
 
 func toRawData(v any) (map[string]json.RawMessage, error) {
@@ -77,9 +96,20 @@ func (t *tokenData) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	var issuedAt int64
+	if raw, ok := rawData[issuedAtKey]; ok {
+		if err := json.Unmarshal(raw, &issuedAt); err != nil {
+			return err
+		}
+	}
+
 	t.NewSessionResponse = NewSessionResponse
 	t.ID = id
 	t.RawData = rawData
+	t.issuedAt = time.Time{}
+	if issuedAt > 0 {
+		t.issuedAt = time.Unix(issuedAt, 0)
+	}
 
 	return nil
 }
@@ -0,0 +1,73 @@
+package signerserver
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// WatchTokenStore loads the session from the token store whenever it is
+// replaced by a newer one, e.g. after a new session is created with
+// `cs token create` because the refresh token expired. It stops when ctx is
+// cancelled.
+func (s *SignerServer) WatchTokenStore(ctx context.Context) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if err := s.session.store.Watch(ctx, s.reloadTokenData); err != nil {
+			s.log.Warn("Token store changes won't be picked up without a restart",
+				zap.Stringer("store", s.session.store),
+				zap.Error(err),
+			)
+		}
+	}()
+}
+
+// reloadTokenData replaces the session with the one in bytes if it is newer,
+// and returns true if it did. The token store is also written by every
+// refresh, in which case it holds the current session and is ignored.
+func (s *SignerServer) reloadTokenData(bytes []byte) bool {
+	store := s.session.store
+	data, err := decodeTokenData(bytes)
+	if err != nil {
+		s.log.Debug("Ignoring undecodable token data", zap.Stringer("store", store), zap.Error(err))
+		return false
+	}
+
+	if data.OrgID != s.OrgID {
+		s.log.Error("Ignoring token data for another organization",
+			zap.Stringer("store", store),
+			zap.String("orgID", data.OrgID),
+		)
+		return false
+	}
+
+	replaced, err := s.session.Replace(data)
+	if errors.Is(err, errOlderSession) {
+		s.log.Warn("Ignoring older session in token store",
+			zap.Stringer("store", store),
+			zap.String("sessionID", data.SessionInfo.SessionId),
+			zap.Error(err),
+		)
+		return false
+	}
+	if err != nil {
+		s.log.Warn("Ignoring invalid session in token store", zap.Stringer("store", store), zap.Error(err))
+		return false
+	}
+	if !replaced {
+		return false
+	}
+
+	state := s.session.State()
+	s.log.Info("Loaded new session from token store",
+		zap.Stringer("store", store),
+		zap.String("sessionID", data.SessionInfo.SessionId),
+		zap.Int32("epoch", data.SessionInfo.Epoch),
+		zap.Time("authTokenExpiry", state.AuthTokenExp),
+		zap.Time("refreshTokenExpiry", state.RefreshTokenExp),
+	)
+	s.updateServingStatus()
+	return true
+}
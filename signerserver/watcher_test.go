@@ -0,0 +1,188 @@
+package signerserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/ava-labs/cube-signer-sidecar/tokenstore"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestTokenFile(t *testing.T, path string, data *tokenData) {
+	t.Helper()
+	bytes, err := json.Marshal(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path+".new", bytes, 0600))
+	require.NoError(t, os.Rename(path+".new", path))
+}
+
+func TestSignerServerWatchTokenStore(t *testing.T) {
+	require := require.New(t)
+
+	current := newTestTokenData("current-token")
+	current.SessionInfo.SessionId = "current-session"
+	current.SessionInfo.Epoch = 2
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	writeTestTokenFile(t, tokenFile, current)
+
+	signerServer := createSignerServer(t, nil, current, keyID)
+	signerServer.session.store = tokenstore.NewFile(tokenFile, logging.NoLog{})
+	signerServer.session.setStatus(SessionExpired)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signerServer.WatchTokenStore(ctx)
+	defer func() {
+		cancel()
+		require.NoError(signerServer.Close(context.Background()))
+	}()
+
+	// an older epoch of the current session is ignored
+	older := newTestTokenData("older-token")
+	older.SessionInfo.SessionId = "current-session"
+	older.SessionInfo.Epoch = 1
+	writeTestTokenFile(t, tokenFile, older)
+
+	// as is a session that can't be refreshed
+	expired := newTestTokenData("expired-token")
+	expired.SessionInfo.SessionId = "expired-session"
+	expired.SessionInfo.RefreshTokenExp = api.EpochDateTime(time.Now().Add(-time.Minute).Unix())
+	writeTestTokenFile(t, tokenFile, expired)
+
+	// a new session replaces the current one, without rewriting the file in
+	// place
+	replacement := newTestTokenData("new-token")
+	replacement.SessionInfo.SessionId = "new-session"
+	require.NoError(os.Remove(tokenFile))
+
+	// The watch is set up in the background, so keep replacing the file
+	// until it is picked up
+	require.Eventually(func() bool {
+		writeTestTokenFile(t, tokenFile, replacement)
+		return signerServer.session.CurrentToken() == "new-token"
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(SessionValid, signerServer.session.Status())
+}
+
+func TestSessionManagerReplace(t *testing.T) {
+	current := newTestTokenData("current-token")
+	current.SessionInfo.SessionId = "current-session"
+	current.SessionInfo.Epoch = 2
+
+	tests := []struct {
+		name      string
+		sessionID string
+		epoch     int32
+		token     string
+		// added to the expiries of the current session
+		authTokenExp    time.Duration
+		refreshTokenExp time.Duration
+		expired         bool
+		replaced        bool
+		err             error
+	}{
+		{name: "same epoch", sessionID: "current-session", epoch: 2, token: "current-token"},
+		{name: "same epoch, later expiry", sessionID: "current-session", epoch: 2, token: "later-token", authTokenExp: time.Minute, replaced: true},
+		{name: "older epoch", sessionID: "current-session", epoch: 1, token: "older-token"},
+		{name: "older epoch, later expiry", sessionID: "current-session", epoch: 1, token: "older-token", authTokenExp: time.Minute},
+		{name: "newer epoch", sessionID: "current-session", epoch: 3, token: "newer-token", replaced: true},
+		{name: "new session", sessionID: "new-session", epoch: 1, token: "new-token", refreshTokenExp: time.Minute, replaced: true},
+		{name: "older session", sessionID: "old-session", epoch: 5, token: "old-token", authTokenExp: time.Minute, err: errOlderSession},
+		{name: "shorter session", sessionID: "old-session", epoch: 1, token: "old-token", refreshTokenExp: -time.Minute, err: errOlderSession},
+		{name: "expired session", sessionID: "new-session", epoch: 1, token: "new-token", expired: true, err: errRefreshTokenExpired},
+		{name: "no token", sessionID: "new-session", epoch: 1, refreshTokenExp: time.Minute, err: errors.New("no session token")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			session := newSessionManager(current, nil, nil, realClock{}, nil, nil)
+
+			data := newTestTokenData(tt.token)
+			data.SessionInfo.SessionId = tt.sessionID
+			data.SessionInfo.Epoch = tt.epoch
+			data.SessionInfo.AuthTokenExp = current.SessionInfo.AuthTokenExp + api.EpochDateTime(tt.authTokenExp.Seconds())
+			data.SessionInfo.RefreshTokenExp = current.SessionInfo.RefreshTokenExp + api.EpochDateTime(tt.refreshTokenExp.Seconds())
+			if tt.expired {
+				data.SessionInfo.RefreshTokenExp = api.EpochDateTime(time.Now().Add(-time.Minute).Unix())
+			}
+
+			replaced, err := session.Replace(data)
+			switch {
+			case tt.err == nil:
+				require.NoError(err)
+			case errors.Is(tt.err, errOlderSession), errors.Is(tt.err, errRefreshTokenExpired):
+				require.ErrorIs(err, tt.err)
+			default:
+				require.EqualError(err, tt.err.Error())
+			}
+			require.Equal(tt.replaced, replaced)
+
+			expectedToken := "current-token"
+			if tt.replaced {
+				expectedToken = tt.token
+			}
+			require.Equal(expectedToken, session.CurrentToken())
+		})
+	}
+}
+
+func TestSessionManagerReplaceUnusable(t *testing.T) {
+	require := require.New(t)
+
+	current := newTestTokenData("current-token")
+	current.SessionInfo.SessionId = "current-session"
+	session := newSessionManager(current, nil, nil, realClock{}, nil, logging.NoLog{})
+	session.setStatus(SessionRevoked)
+
+	// any refreshable session replaces a revoked one
+	data := newTestTokenData("new-token")
+	data.SessionInfo.SessionId = "new-session"
+	data.SessionInfo.RefreshTokenExp = current.SessionInfo.RefreshTokenExp - 60
+	replaced, err := session.Replace(data)
+	require.NoError(err)
+	require.True(replaced)
+	require.Equal(SessionValid, session.Status())
+}
+
+func TestSignerServerReloadTokenData(t *testing.T) {
+	require := require.New(t)
+
+	current := newTestTokenData("current-token")
+	current.SessionInfo.SessionId = "current-session"
+	current.SessionInfo.Epoch = 2
+	signerServer := createSignerServer(t, nil, current, keyID)
+	signerServer.session.store = &conflictingStore{}
+
+	reload := func(data *tokenData) bool {
+		bytes, err := json.Marshal(data)
+		require.NoError(err)
+		return signerServer.reloadTokenData(bytes)
+	}
+
+	// a different session that expires sooner, e.g. from a stale backup, is
+	// rejected
+	stale := newTestTokenData("stale-token")
+	stale.SessionInfo.SessionId = "stale-session"
+	stale.SessionInfo.Epoch = 7
+	stale.SessionInfo.RefreshTokenExp = current.SessionInfo.RefreshTokenExp - 60
+	require.False(reload(stale))
+	require.Equal("current-token", signerServer.session.CurrentToken())
+
+	// while the current session at the same epoch with a later expiry is
+	// adopted
+	extended := newTestTokenData("extended-token")
+	extended.SessionInfo.SessionId = "current-session"
+	extended.SessionInfo.Epoch = 2
+	extended.SessionInfo.AuthTokenExp = current.SessionInfo.AuthTokenExp + 60
+	require.True(reload(extended))
+	require.Equal("extended-token", signerServer.session.CurrentToken())
+}
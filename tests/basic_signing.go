@@ -22,8 +22,8 @@ func BasicSigning(log logging.Logger) {
 	cancelFn := utils.RunSigner(context.Background(), configPath)
 	defer cancelFn()
 
-	// wait for the signer to start
-	time.Sleep(2 * time.Second)
+	// wait for the signer to be ready to serve requests
+	utils.WaitForSignerReady(context.Background(), "127.0.0.1:50051", 30*time.Second)
 
 	signerClient, err := rpcsigner.NewClient(context.Background(), "127.0.0.1:50051")
 	Expect(err).Should(BeNil())
@@ -8,8 +8,13 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/ava-labs/cube-signer-sidecar/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
 	. "github.com/onsi/gomega"
 )
 
@@ -20,6 +25,8 @@ const (
 	DefaultKeyID                = "Key#BlsAvaIcm_0x856218c1a1a84cd4e25321fe7bde03260d2686dad5c9ddd05e77509cc0ef3114d7290810843748a2bd8bb3a2ff8c4d6e"
 	DefaultSignerEndpoint       = "https://gamma.signer.cubist.dev"
 	DefaultPort                 = 50051
+	DefaultHealthPort           = 8080
+	DefaultMetricsPort          = 9090
 )
 
 func BuildCubistSigner() {
@@ -30,8 +37,21 @@ func BuildCubistSigner() {
 	Expect(err).Should(BeNil())
 }
 
+// WriteConfig writes the fields of cfg that are set to a temporary config
+// file, so that the sidecar's defaults apply to the others.
 func WriteConfig(cfg *config.Config, fname string) string {
-	data, err := json.MarshalIndent(cfg, "", "\t")
+	data, err := json.Marshal(cfg)
+	Expect(err).Should(BeNil())
+
+	var fields map[string]any
+	Expect(json.Unmarshal(data, &fields)).Should(Succeed())
+	for name, value := range fields {
+		if isZero(value) {
+			delete(fields, name)
+		}
+	}
+
+	data, err = json.MarshalIndent(fields, "", "\t")
 	Expect(err).Should(BeNil())
 
 	f, err := os.CreateTemp(os.TempDir(), fname)
@@ -46,12 +66,37 @@ func WriteConfig(cfg *config.Config, fname string) string {
 	return configPath
 }
 
+// isZero returns true if value, decoded from JSON, is the zero value of its
+// type.
+func isZero(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !value
+	case float64:
+		return value == 0
+	case string:
+		return value == ""
+	case []any:
+		return len(value) == 0
+	case map[string]any:
+		return len(value) == 0
+	default:
+		return false
+	}
+}
+
 func CreateDefaultConfig() *config.Config {
 	return &config.Config{
-		TokenFilePath:  DefaultTokenPath,
-		KeyID:          DefaultKeyID,
-		SignerEndpoint: DefaultSignerEndpoint,
-		Port:           DefaultPort,
+		TokenFilePath:   DefaultTokenPath,
+		KeyID:           DefaultKeyID,
+		Port:            DefaultPort,
+		HealthPort:      DefaultHealthPort,
+		MetricsPort:     DefaultMetricsPort,
+		LogLevel:        "info",
+		LogFormat:       "json",
+		SignerEndpoints: []string{DefaultSignerEndpoint},
 	}
 }
 
@@ -88,3 +133,20 @@ func RunSigner(ctx context.Context, cfgPath string) context.CancelFunc {
 		cmd.Wait()
 	}
 }
+
+// WaitForSignerReady blocks until the gRPC health service of the signer at
+// addr reports the signer service as SERVING.
+func WaitForSignerReady(ctx context.Context, addr string, timeout time.Duration) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	Expect(err).Should(BeNil())
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	Eventually(func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "signer.Signer"})
+		if err != nil {
+			return healthpb.HealthCheckResponse_UNKNOWN
+		}
+		return res.Status
+	}, timeout, 100*time.Millisecond).Should(Equal(healthpb.HealthCheckResponse_SERVING))
+}
@@ -0,0 +1,135 @@
+// Package tlsconfig builds the TLS configuration of the signer gRPC server.
+// The certificate and client CA files are reloaded when they change, so that
+// certificates can be rotated without restarting the sidecar.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+var errNoCertificates = errors.New("no certificates found")
+
+// NewServerConfig returns a server TLS configuration serving the certificate
+// in certFile and keyFile. If clientCAFile is non-empty, clients must present
+// a certificate signed by one of the CAs in it.
+func NewServerConfig(certFile, keyFile, clientCAFile string, log logging.Logger) (*tls.Config, error) {
+	r := &reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		log:          log,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfigForClient,
+	}, nil
+}
+
+// reloader holds the current TLS configuration and reloads it whenever the
+// modification time of one of the files changes.
+type reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	log          logging.Logger
+
+	lock     sync.Mutex
+	config   *tls.Config
+	modTimes []time.Time
+}
+
+func (r *reloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTimes, err := r.readModTimes()
+	if err != nil || slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+		// keep serving the current configuration if the files can't be read
+		return r.config, nil
+	}
+
+	if err := r.reloadLocked(); err != nil {
+		r.log.Warn("Failed to reload TLS configuration, serving the previous one", zap.Error(err))
+		// don't retry until the files change again
+		r.modTimes = modTimes
+	}
+	return r.config, nil
+}
+
+func (r *reloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.reloadLocked()
+}
+
+func (r *reloader) reloadLocked() error {
+	// read the modification times first so a change made while loading is
+	// picked up by the next handshake
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to parse client CA file %s: %w", r.clientCAFile, errNoCertificates)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if r.config != nil {
+		r.log.Info("Reloaded TLS configuration")
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *reloader) readModTimes() ([]time.Time, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
@@ -0,0 +1,234 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(err)
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	require := require.New(t)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(err)
+
+	require.NoError(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	require.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+	}
+}
+
+// handshake connects a client using clientConfig to a server using
+// serverConfig, and returns the certificate presented by the server.
+func handshake(serverConfig *tls.Config, clientConfig *tls.Config) (*x509.Certificate, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		server := tls.Server(serverConn, serverConfig)
+		err := server.Handshake()
+		if err == nil {
+			// TLS 1.3 client certificates are verified after the client
+			// handshake completes, so wait for the client to read
+			_, err = server.Write([]byte{0})
+		}
+		serverErr <- err
+		_ = serverConn.Close()
+	}()
+
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	if err := <-serverErr; err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestServerConfigReloadsCertificate(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil, true)
+	certFile, keyFile := newTestCert(t, "server-1", ca, false).write(t, dir, "server")
+
+	serverConfig, err := NewServerConfig(certFile, keyFile, "", logging.NoLog{})
+	require.NoError(err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS12}
+
+	cert, err := handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-1", cert.Subject.CommonName)
+
+	// rotate the certificate
+	newTestCert(t, "server-2", ca, false).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	require.NoError(os.Chtimes(certFile, future, future))
+
+	cert, err = handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-2", cert.Subject.CommonName)
+
+	// keep serving the current certificate if the new one is invalid
+	require.NoError(os.WriteFile(keyFile, []byte("invalid"), 0600))
+	future = future.Add(time.Minute)
+	require.NoError(os.Chtimes(keyFile, future, future))
+
+	cert, err = handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-2", cert.Subject.CommonName)
+}
+
+func TestServerConfigRetriesReloadOnlyOnChange(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil, true)
+	certFile, keyFile := newTestCert(t, "server-1", ca, false).write(t, dir, "server")
+
+	serverConfig, err := NewServerConfig(certFile, keyFile, "", logging.NoLog{})
+	require.NoError(err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS12}
+
+	// the new key doesn't match the certificate, so it fails to load
+	certFile2, keyFile2 := newTestCert(t, "server-2", ca, false).write(t, dir, "server-2")
+	certPEM, err := os.ReadFile(certFile2)
+	require.NoError(err)
+	require.NoError(os.WriteFile(certFile, certPEM, 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(os.Chtimes(certFile, future, future))
+	require.NoError(os.Chtimes(keyFile, future, future))
+
+	cert, err := handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-1", cert.Subject.CommonName)
+
+	// fixing the files without changing their modification times isn't
+	// picked up, as the failed files aren't loaded again
+	keyPEM, err := os.ReadFile(keyFile2)
+	require.NoError(err)
+	require.NoError(os.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(os.Chtimes(keyFile, future, future))
+
+	cert, err = handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-1", cert.Subject.CommonName)
+
+	// until they change again
+	future = future.Add(time.Minute)
+	require.NoError(os.Chtimes(keyFile, future, future))
+
+	cert, err = handshake(serverConfig, clientConfig)
+	require.NoError(err)
+	require.Equal("server-2", cert.Subject.CommonName)
+}
+
+func TestServerConfigRequiresClientCertificate(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil, true)
+	certFile, keyFile := newTestCert(t, "server", ca, false).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	serverConfig, err := NewServerConfig(certFile, keyFile, caFile, logging.NoLog{})
+	require.NoError(err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// no client certificate
+	_, err = handshake(serverConfig, &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS12})
+	require.Error(err)
+
+	// client certificate signed by an unknown CA
+	otherCA := newTestCert(t, "other-ca", nil, true)
+	_, err = handshake(serverConfig, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{newTestCert(t, "client", otherCA, false).tlsCertificate()},
+	})
+	require.Error(err)
+
+	// client certificate signed by the client CA
+	_, err = handshake(serverConfig, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{newTestCert(t, "client", ca, false).tlsCertificate()},
+	})
+	require.NoError(err)
+}
@@ -0,0 +1,303 @@
+package tokenstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeySize is the size of token encryption keys, for AES-256.
+	KeySize = 32
+
+	envelopeVersion   = 1
+	envelopeAlgorithm = "AES-256-GCM"
+)
+
+var (
+	_ TokenStore = (*Encrypted)(nil)
+
+	// The additional data binds ciphertexts to their use, so that a data key
+	// can't be passed off as token data or vice versa
+	dataKeyAAD   = []byte("cube-signer-sidecar data key v1")
+	tokenDataAAD = []byte("cube-signer-sidecar token data v1")
+
+	errInvalidKeySize = fmt.Errorf("token encryption key must be %d bytes", KeySize)
+	errNotEncrypted   = errors.New("token data is not encrypted")
+)
+
+// envelope is the encrypted form of token data. The token data is encrypted
+// with a random data key, which is itself encrypted with the token encryption
+// key, so that the encryption key only ever encrypts random data. envelope is
+// stored as JSON, so that stores which expect JSON token data accept it.
+type envelope struct {
+	Envelope *envelopeData `json:"envelope"`
+}
+
+type envelopeData struct {
+	Version      int    `json:"version"`
+	Algorithm    string `json:"algorithm"`
+	KeyNonce     []byte `json:"key_nonce"`
+	EncryptedKey []byte `json:"encrypted_key"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// Encrypted encrypts token data before it is saved to an underlying store,
+// and decrypts it when it is loaded. Unencrypted token data is still loaded,
+// so that existing sessions are encrypted on their next save.
+type Encrypted struct {
+	store TokenStore
+	key   []byte
+	log   logging.Logger
+
+	lock sync.Mutex
+	// plaintext is the unencrypted token data last read from the store, until
+	// it is encrypted
+	plaintext []byte
+}
+
+func NewEncrypted(store TokenStore, key []byte, log logging.Logger) (*Encrypted, error) {
+	if len(key) != KeySize {
+		return nil, errInvalidKeySize
+	}
+	return &Encrypted{
+		store: store,
+		key:   key,
+		log:   log,
+	}, nil
+}
+
+func (e *Encrypted) String() string {
+	return e.store.String()
+}
+
+func (e *Encrypted) Load(ctx context.Context) ([]byte, error) {
+	data, err := e.store.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return e.decrypt(data)
+}
+
+// Save encrypts data and saves it to the underlying store. If the store held
+// unencrypted token data, it is first encrypted in place, so that it isn't
+// left behind in the backup the file store keeps of the previous contents.
+func (e *Encrypted) Save(ctx context.Context, data []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.plaintext != nil {
+		if err := e.save(ctx, e.plaintext); err != nil {
+			return err
+		}
+		e.plaintext = nil
+	}
+	return e.save(ctx, data)
+}
+
+func (e *Encrypted) save(ctx context.Context, data []byte) error {
+	encrypted, err := Encrypt(e.key, data)
+	if err != nil {
+		return err
+	}
+	return e.store.Save(ctx, encrypted)
+}
+
+func (e *Encrypted) Watch(ctx context.Context, onChange func([]byte) bool) error {
+	return e.store.Watch(ctx, func(data []byte) bool {
+		decrypted, err := e.decrypt(data)
+		if err != nil {
+			e.log.Warn("Ignoring token data that can't be decrypted", zap.Stringer("store", e), zap.Error(err))
+			return false
+		}
+		return onChange(decrypted)
+	})
+}
+
+func (e *Encrypted) decrypt(data []byte) ([]byte, error) {
+	decrypted, err := Decrypt(e.key, data)
+	if errors.Is(err, errNotEncrypted) {
+		e.log.Warn("Token data is not encrypted, it will be encrypted when it is next saved", zap.Stringer("store", e))
+		e.lock.Lock()
+		e.plaintext = data
+		e.lock.Unlock()
+		return data, nil
+	}
+	return decrypted, err
+}
+
+// IsEncrypted returns true if data is encrypted token data.
+func IsEncrypted(data []byte) bool {
+	var env envelope
+	return json.Unmarshal(data, &env) == nil && env.Envelope != nil
+}
+
+// Encrypt encrypts token data with key.
+func Encrypt(key, data []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, errInvalidKeySize
+	}
+
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	keyNonce, encryptedKey, err := seal(key, dataKey, dataKeyAAD)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ciphertext, err := seal(dataKey, data, tokenDataAAD)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{Envelope: &envelopeData{
+		Version:      envelopeVersion,
+		Algorithm:    envelopeAlgorithm,
+		KeyNonce:     keyNonce,
+		EncryptedKey: encryptedKey,
+		Nonce:        nonce,
+		Ciphertext:   ciphertext,
+	}})
+}
+
+// Decrypt decrypts token data encrypted with key.
+func Decrypt(key, data []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, errInvalidKeySize
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to decode token data: %w", err)
+	}
+	if env.Envelope == nil {
+		return nil, errNotEncrypted
+	}
+	if env.Envelope.Version != envelopeVersion || env.Envelope.Algorithm != envelopeAlgorithm {
+		return nil, fmt.Errorf("unsupported token encryption version %d (%s)", env.Envelope.Version, env.Envelope.Algorithm)
+	}
+
+	dataKey, err := open(key, env.Envelope.KeyNonce, env.Envelope.EncryptedKey, dataKeyAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key, the token encryption key may be wrong: %w", err)
+	}
+	decrypted, err := open(dataKey, env.Envelope.Nonce, env.Envelope.Ciphertext, tokenDataAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token data: %w", err)
+	}
+	return decrypted, nil
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, []byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+func open(key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(nonce))
+	}
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ValidateKeySource returns an error if source isn't a valid token encryption
+// key source, without reading the key.
+func ValidateKeySource(source string) error {
+	_, _, err := parseKeySource(source)
+	return err
+}
+
+// ReadKey reads a base64 encoded token encryption key from source, one of
+// env:NAME, file:PATH or fd:N. A file descriptor can only be read once.
+func ReadKey(source string) ([]byte, error) {
+	kind, value, err := parseKeySource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []byte
+	switch kind {
+	case "env":
+		encoded = []byte(os.Getenv(value))
+		if len(encoded) == 0 {
+			return nil, fmt.Errorf("token encryption key environment variable %s is not set", value)
+		}
+	case "file":
+		encoded, err = os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token encryption key: %w", err)
+		}
+	case "fd":
+		fd, _ := strconv.Atoi(value)
+		file := os.NewFile(uintptr(fd), "token-encryption-key")
+		if file == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer file.Close()
+		encoded, err = io.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token encryption key from file descriptor %d: %w", fd, err)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("token encryption key must be base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, errInvalidKeySize
+	}
+	return key, nil
+}
+
+func parseKeySource(source string) (string, string, error) {
+	kind, value, ok := strings.Cut(source, ":")
+	if !ok || value == "" {
+		return "", "", fmt.Errorf("invalid token encryption key source %q, must be one of env:NAME, file:PATH or fd:N", source)
+	}
+	switch kind {
+	case "env", "file":
+	case "fd":
+		if fd, err := strconv.Atoi(value); err != nil || fd < 0 {
+			return "", "", fmt.Errorf("invalid token encryption key file descriptor %q", value)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid token encryption key source %q, must be one of env:NAME, file:PATH or fd:N", source)
+	}
+	return kind, value, nil
+}
@@ -0,0 +1,211 @@
+package tokenstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/stretchr/testify/require"
+)
+
+const testTokenData = `{"token":"session-token","refresh_token":"refresh-token","org_id":"Org#test"}`
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	require := require.New(t)
+
+	key := newTestKey(t)
+	encrypted, err := Encrypt(key, []byte(testTokenData))
+	require.NoError(err)
+	require.True(IsEncrypted(encrypted))
+	require.False(IsEncrypted([]byte(testTokenData)))
+	require.True(json.Valid(encrypted))
+	require.NotContains(string(encrypted), "session-token")
+	require.NotContains(string(encrypted), "refresh-token")
+
+	decrypted, err := Decrypt(key, encrypted)
+	require.NoError(err)
+	require.Equal(testTokenData, string(decrypted))
+
+	// every encryption uses a new data key and nonce
+	again, err := Encrypt(key, []byte(testTokenData))
+	require.NoError(err)
+	require.NotEqual(encrypted, again)
+
+	_, err = Decrypt(newTestKey(t), encrypted)
+	require.ErrorContains(err, "failed to decrypt data key")
+
+	_, err = Decrypt(key, []byte(testTokenData))
+	require.ErrorIs(err, errNotEncrypted)
+
+	_, err = Encrypt(key[:16], []byte(testTokenData))
+	require.ErrorIs(err, errInvalidKeySize)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := newTestKey(t)
+	encrypted, err := Encrypt(key, []byte(testTokenData))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		tamper func(*envelopeData)
+	}{
+		{
+			name:   "ciphertext",
+			tamper: func(e *envelopeData) { e.Ciphertext[0] ^= 1 },
+		},
+		{
+			name:   "encrypted key",
+			tamper: func(e *envelopeData) { e.EncryptedKey[0] ^= 1 },
+		},
+		{
+			name:   "nonce",
+			tamper: func(e *envelopeData) { e.Nonce = e.Nonce[1:] },
+		},
+		{
+			name: "swapped ciphertexts",
+			tamper: func(e *envelopeData) {
+				e.KeyNonce, e.Nonce = e.Nonce, e.KeyNonce
+				e.EncryptedKey, e.Ciphertext = e.Ciphertext, e.EncryptedKey
+			},
+		},
+		{
+			name:   "version",
+			tamper: func(e *envelopeData) { e.Version = 2 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env envelope
+			require.NoError(t, json.Unmarshal(encrypted, &env))
+			tt.tamper(env.Envelope)
+			tampered, err := json.Marshal(env)
+			require.NoError(t, err)
+
+			_, err = Decrypt(key, tampered)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(path, []byte(testTokenData), 0600))
+
+	key := newTestKey(t)
+	store, err := NewEncrypted(NewFile(path, logging.NoLog{}), key, logging.NoLog{})
+	require.NoError(err)
+	ctx := context.Background()
+
+	// existing token files are still loaded
+	data, err := store.Load(ctx)
+	require.NoError(err)
+	require.Equal(testTokenData, string(data))
+
+	// and are encrypted when saved
+	require.NoError(store.Save(ctx, data))
+	contents, err := os.ReadFile(path)
+	require.NoError(err)
+	require.True(IsEncrypted(contents))
+
+	data, err = store.Load(ctx)
+	require.NoError(err)
+	require.Equal(testTokenData, string(data))
+
+	_, err = NewEncrypted(NewFile(path, logging.NoLog{}), key[:16], logging.NoLog{})
+	require.ErrorIs(err, errInvalidKeySize)
+}
+
+func TestEncryptedStoreBackup(t *testing.T) {
+	require := require.New(t)
+
+	// the token file and its backup hold unencrypted sessions
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(path, []byte(testTokenData), 0600))
+	require.NoError(os.WriteFile(path+backupSuffix, []byte(`{"token":"previous"}`), 0600))
+
+	store, err := NewEncrypted(NewFile(path, logging.NoLog{}), newTestKey(t), logging.NoLog{})
+	require.NoError(err)
+	ctx := context.Background()
+
+	_, err = store.Load(ctx)
+	require.NoError(err)
+	require.NoError(store.Save(ctx, []byte(`{"token":"next"}`)))
+
+	// no unencrypted session is left behind
+	for _, file := range []string{path, path + backupSuffix} {
+		contents, err := os.ReadFile(file)
+		require.NoError(err)
+		require.True(IsEncrypted(contents), file)
+	}
+
+	// and the backup still holds the previous session
+	backup, err := os.ReadFile(path + backupSuffix)
+	require.NoError(err)
+	decrypted, err := store.decrypt(backup)
+	require.NoError(err)
+	require.Equal(testTokenData, string(decrypted))
+}
+
+func TestReadKey(t *testing.T) {
+	require := require.New(t)
+
+	key := newTestKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	t.Setenv("TEST_TOKEN_ENCRYPTION_KEY", encoded)
+	read, err := ReadKey("env:TEST_TOKEN_ENCRYPTION_KEY")
+	require.NoError(err)
+	require.Equal(key, read)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(os.WriteFile(keyFile, []byte(encoded+"\n"), 0600))
+	read, err = ReadKey("file:" + keyFile)
+	require.NoError(err)
+	require.Equal(key, read)
+
+	r, w, err := os.Pipe()
+	require.NoError(err)
+	_, err = w.Write([]byte(encoded))
+	require.NoError(err)
+	require.NoError(w.Close())
+	// ReadKey takes ownership of the descriptor, so it is given a copy
+	fd, err := syscall.Dup(int(r.Fd()))
+	require.NoError(err)
+	require.NoError(r.Close())
+	read, err = ReadKey("fd:" + strconv.Itoa(fd))
+	require.NoError(err)
+	require.Equal(key, read)
+
+	_, err = ReadKey("env:TEST_TOKEN_ENCRYPTION_KEY_UNSET")
+	require.ErrorContains(err, "is not set")
+
+	t.Setenv("TEST_TOKEN_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key[:16]))
+	_, err = ReadKey("env:TEST_TOKEN_ENCRYPTION_KEY")
+	require.ErrorIs(err, errInvalidKeySize)
+
+	t.Setenv("TEST_TOKEN_ENCRYPTION_KEY", "not base64!")
+	_, err = ReadKey("env:TEST_TOKEN_ENCRYPTION_KEY")
+	require.ErrorContains(err, "base64")
+
+	for _, source := range []string{"", "env:", "kms:key", "fd:-1", "fd:three", encoded} {
+		require.Error(ValidateKeySource(source), source)
+	}
+}
@@ -0,0 +1,204 @@
+package tokenstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	tokenFileMode = 0600
+
+	backupSuffix = ".bak"
+	tempSuffix   = ".tmp"
+)
+
+var _ TokenStore = (*File)(nil)
+
+// File stores the token data in a local file. The file is replaced
+// atomically on every save, and its previous contents are kept at path.bak.
+type File struct {
+	path string
+	log  logging.Logger
+}
+
+func NewFile(path string, log logging.Logger) *File {
+	return &File{
+		path: filepath.Clean(path),
+		log:  log,
+	}
+}
+
+func (f *File) String() string {
+	return f.path
+}
+
+// Load reads the token file, falling back to the backup of the previous
+// session if the token file isn't valid JSON.
+func (f *File) Load(context.Context) ([]byte, error) {
+	data, err := readJSON(f.path)
+	if err == nil {
+		return data, nil
+	}
+
+	backup, backupErr := readJSON(f.path + backupSuffix)
+	if backupErr != nil {
+		return nil, err
+	}
+
+	f.log.Warn("Failed to load token file, using the backup of the previous session",
+		zap.String("path", f.path),
+		zap.Error(err),
+	)
+	return backup, nil
+}
+
+func readJSON(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("failed to decode token data: %s is not valid JSON", path)
+	}
+	return data, nil
+}
+
+// Save atomically replaces the token file with data, keeping its previous
+// contents at path.bak. Both files are only ever replaced by renaming a fully
+// written and synced temporary file, so a crash at any point leaves a
+// readable token file behind.
+func (f *File) Save(_ context.Context, data []byte) error {
+	previous, err := os.ReadFile(f.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read token file: %w", err)
+	case bytes.Equal(previous, data):
+		// Rewriting the same session would replace the backup with it
+		return nil
+	default:
+		if err := WriteFileAtomic(f.path+backupSuffix, previous); err != nil {
+			return fmt.Errorf("failed to back up token file: %w", err)
+		}
+	}
+
+	if err := WriteFileAtomic(f.path, data); err != nil {
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+	return nil
+}
+
+// Watch calls onChange with the contents of the token file whenever it is
+// written or replaced.
+func (f *File) Watch(ctx context.Context, onChange func([]byte) bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create token file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Watch the directory rather than the file, as token files are usually
+	// replaced rather than written to, which a watch on the file doesn't
+	// survive.
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		return fmt.Errorf("failed to watch token file: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Temporary and backup files are written by Save
+			name := filepath.Clean(event.Name)
+			if isTempFile(name, f.path) || name == f.path+backupSuffix || event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			data, err := readJSON(f.path)
+			if err != nil {
+				// The file may be partially written, the next write is
+				// picked up
+				f.log.Debug("Ignoring unreadable token file", zap.String("path", f.path), zap.Error(err))
+				continue
+			}
+			// Saves aren't conditional, so whether the data was adopted
+			// doesn't matter
+			_ = onChange(data)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			f.log.Warn("Token file watcher failed", zap.String("path", f.path), zap.Error(err))
+		}
+	}
+}
+
+// WriteFileAtomic writes data to a new temporary file next to path, readable
+// only by its owner, syncs it and renames it over path. The directory is
+// synced so that the rename survives a crash.
+func WriteFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+
+	if err := writeAndSync(file, data); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func writeAndSync(file *os.File, data []byte) error {
+	if err := file.Chmod(tokenFileMode); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// isTempFile returns true if name is a temporary file written by
+// WriteFileAtomic, for path or for its backup.
+func isTempFile(name, path string) bool {
+	base := filepath.Base(name)
+	return filepath.Dir(name) == filepath.Dir(path) &&
+		strings.HasPrefix(base, filepath.Base(path)+".") &&
+		strings.HasSuffix(base, tempSuffix)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,132 @@
+package tokenstore
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSave(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(path, []byte(`{"token":"a long first token"}`), 0644))
+	store := NewFile(path, logging.NoLog{})
+
+	require.NoError(store.Save(context.Background(), []byte(`{"token":"second"}`)))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(err)
+	require.Equal(`{"token":"second"}`, string(contents))
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(fs.FileMode(tokenFileMode), info.Mode().Perm())
+
+	backup, err := os.ReadFile(path + backupSuffix)
+	require.NoError(err)
+	require.Equal(`{"token":"a long first token"}`, string(backup))
+
+	info, err = os.Stat(path + backupSuffix)
+	require.NoError(err)
+	require.Equal(fs.FileMode(tokenFileMode), info.Mode().Perm())
+
+	// rewriting the same session keeps the backup of the previous one
+	require.NoError(store.Save(context.Background(), []byte(`{"token":"second"}`)))
+	backup, err = os.ReadFile(path + backupSuffix)
+	require.NoError(err)
+	require.Equal(`{"token":"a long first token"}`, string(backup))
+
+	// no temporary files are left behind
+	tmpFiles, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*"+tempSuffix))
+	require.NoError(err)
+	require.Empty(tmpFiles)
+}
+
+func TestFileLoadFallsBackToBackup(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(path+backupSuffix, []byte(`{"token":"previous"}`), 0600))
+
+	// a token file truncated by a crash
+	require.NoError(os.WriteFile(path, []byte(`{"token":"cur`), 0600))
+	store := NewFile(path, logging.NoLog{})
+
+	data, err := store.Load(context.Background())
+	require.NoError(err)
+	require.Equal(`{"token":"previous"}`, string(data))
+
+	// without a backup the error is returned
+	require.NoError(os.Remove(path + backupSuffix))
+	_, err = store.Load(context.Background())
+	require.ErrorContains(err, "not valid JSON")
+}
+
+func TestFileWatch(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(os.WriteFile(path, []byte(`{"token":"first"}`), 0600))
+	store := NewFile(path, logging.NoLog{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.Watch(ctx, func(data []byte) bool {
+			changes <- string(data)
+			return true
+		})
+	}()
+
+	// Writes may race with the watch being set up, so keep replacing the
+	// file until a change is seen
+	attempt := 0
+	require.Eventually(func() bool {
+		attempt++
+		data := fmt.Sprintf(`{"token":"%d"}`, attempt)
+		require.NoError(store.Save(context.Background(), []byte(data)))
+		for {
+			select {
+			case change := <-changes:
+				if change == data {
+					return true
+				}
+			case <-time.After(10 * time.Millisecond):
+				return false
+			}
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(<-done)
+}
+
+func TestIsTempFile(t *testing.T) {
+	path := filepath.Join("dir", "token.json")
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{name: filepath.Join("dir", "token.json.123456.tmp"), expected: true},
+		{name: filepath.Join("dir", "token.json.bak.123456.tmp"), expected: true},
+		{name: filepath.Join("dir", "token.json"), expected: false},
+		{name: filepath.Join("dir", "token.json.bak"), expected: false},
+		{name: filepath.Join("dir", "other.json.123456.tmp"), expected: false},
+		{name: filepath.Join("other", "token.json.123456.tmp"), expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, isTempFile(tt.name, path))
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package tokenstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	// serviceAccountDir is where Kubernetes mounts the credentials of the pod's
+	// service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
+var (
+	_ TokenStore = (*KubernetesSecret)(nil)
+
+	errWatchExpired = errors.New("watch resource version expired")
+	errNotInCluster = errors.New("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+)
+
+// KubernetesSecret stores the token data under a key of a Kubernetes Secret,
+// through the API server. Saves are conditional on the resourceVersion of the
+// Secret last loaded, saved or adopted from Watch, so that a session written
+// by someone else is never silently overwritten.
+//
+// The pod's service account needs the get, list, watch and patch verbs on the
+// Secret.
+type KubernetesSecret struct {
+	baseURL   string
+	client    *http.Client
+	authToken func() (string, error)
+	namespace string
+	name      string
+	key       string
+	log       logging.Logger
+
+	lock sync.Mutex
+	// resourceVersion is the precondition of the next save
+	resourceVersion string
+	// watchVersion is where the next watch resumes from, which may be ahead
+	// of resourceVersion with changes that weren't adopted and bookmarks
+	watchVersion string
+}
+
+// NewKubernetesSecret returns a store for key of the Secret namespace/name,
+// authenticating with the in-cluster service account. If namespace is empty,
+// the namespace of the pod is used.
+func NewKubernetesSecret(namespace, name, key string, log logging.Logger) (*KubernetesSecret, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errNotInCluster
+	}
+
+	caCert, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in cluster CA")
+	}
+
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    caPool,
+			},
+		},
+	}
+
+	// Service account tokens are rotated, so the token is read for every
+	// request
+	authToken := func() (string, error) {
+		token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+		if err != nil {
+			return "", fmt.Errorf("failed to read service account token: %w", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	baseURL := "https://" + net.JoinHostPort(host, port)
+	return newKubernetesSecret(baseURL, client, authToken, namespace, name, key, log), nil
+}
+
+func newKubernetesSecret(
+	baseURL string,
+	client *http.Client,
+	authToken func() (string, error),
+	namespace string,
+	name string,
+	key string,
+	log logging.Logger,
+) *KubernetesSecret {
+	return &KubernetesSecret{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		client:    client,
+		authToken: authToken,
+		namespace: namespace,
+		name:      name,
+		key:       key,
+		log:       log,
+	}
+}
+
+func (k *KubernetesSecret) String() string {
+	return fmt.Sprintf("secret %s/%s[%s]", k.namespace, k.name, k.key)
+}
+
+// secret is the subset of a Kubernetes Secret used by the store. Data values
+// are base64 encoded by the API, which encoding/json decodes into []byte.
+type secret struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+// status is the body of Kubernetes API errors.
+type status struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (k *KubernetesSecret) Load(ctx context.Context) ([]byte, error) {
+	data, resourceVersion, err := k.get(ctx)
+	if resourceVersion != "" {
+		k.setResourceVersion(resourceVersion)
+		k.setWatchVersion(resourceVersion)
+	}
+	return data, err
+}
+
+// get returns the token data and the resourceVersion of the Secret. The
+// resourceVersion is also returned if the Secret has no token data.
+func (k *KubernetesSecret) get(ctx context.Context) ([]byte, string, error) {
+	res, err := k.do(ctx, http.MethodGet, k.secretURL(), "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to get %s: %w", k, readStatus(res))
+	}
+
+	var s secret
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s: %w", k, err)
+	}
+
+	data, ok := s.Data[k.key]
+	if !ok {
+		return nil, s.Metadata.ResourceVersion, fmt.Errorf("failed to load %s: %w", k, errMissingTokenData)
+	}
+	return data, s.Metadata.ResourceVersion, nil
+}
+
+// Save patches the key of the Secret with data, if the Secret hasn't been
+// modified since it was last loaded, saved or adopted from Watch. Otherwise
+// ErrConflict is returned.
+func (k *KubernetesSecret) Save(ctx context.Context, data []byte) error {
+	resourceVersion := k.getResourceVersion()
+	if resourceVersion == "" {
+		return errNotLoaded
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]string{"resourceVersion": resourceVersion},
+		"data":     map[string][]byte{k.key: data},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := k.do(ctx, http.MethodPatch, k.secretURL(), "application/merge-patch+json", bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return fmt.Errorf("failed to save %s: %w", k, ErrConflict)
+	default:
+		return fmt.Errorf("failed to save %s: %w", k, readStatus(res))
+	}
+
+	var s secret
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", k, err)
+	}
+	k.setResourceVersion(s.Metadata.ResourceVersion)
+	return nil
+}
+
+// Watch watches the Secret through the API server, reconnecting with backoff
+// whenever the watch ends.
+func (k *KubernetesSecret) Watch(ctx context.Context, onChange func([]byte) bool) error {
+	backoff := minWatchBackoff
+	for {
+		err := k.watch(ctx, onChange)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if errors.Is(err, errWatchExpired) {
+			// Events were missed, so start over from the current state
+			var (
+				data            []byte
+				resourceVersion string
+			)
+			data, resourceVersion, err = k.get(ctx)
+			if err == nil {
+				k.change(resourceVersion, data, onChange)
+				backoff = minWatchBackoff
+				continue
+			}
+		}
+
+		k.log.Warn("Secret watch ended, reconnecting",
+			zap.Stringer("secret", k),
+			zap.Error(err),
+			zap.Duration("backoff", backoff),
+		)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxWatchBackoff)
+	}
+}
+
+func (k *KubernetesSecret) watch(ctx context.Context, onChange func([]byte) bool) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"fieldSelector":       {"metadata.name=" + k.name},
+		"resourceVersion":     {k.getWatchVersion()},
+		"allowWatchBookmarks": {"true"},
+	}
+	watchURL := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets?%s", k.baseURL, url.PathEscape(k.namespace), query.Encode())
+
+	res, err := k.do(ctx, http.MethodGet, watchURL, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to watch %s: %w", k, readStatus(res))
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("failed to read watch event: %w", err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var s secret
+			if err := json.Unmarshal(event.Object, &s); err != nil {
+				return fmt.Errorf("failed to decode watch event: %w", err)
+			}
+			if data, ok := s.Data[k.key]; ok {
+				k.change(s.Metadata.ResourceVersion, data, onChange)
+			} else {
+				k.setWatchVersion(s.Metadata.ResourceVersion)
+			}
+		case "BOOKMARK":
+			// Bookmarks only carry the resourceVersion of the collection,
+			// which is where the next watch resumes from but isn't the
+			// resourceVersion of the Secret
+			var s secret
+			if err := json.Unmarshal(event.Object, &s); err != nil {
+				return fmt.Errorf("failed to decode watch event: %w", err)
+			}
+			k.setWatchVersion(s.Metadata.ResourceVersion)
+		case "DELETED":
+			k.log.Warn("Secret was deleted", zap.Stringer("secret", k))
+		case "ERROR":
+			var st status
+			if err := json.Unmarshal(event.Object, &st); err != nil {
+				return fmt.Errorf("failed to decode watch error: %w", err)
+			}
+			if st.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return fmt.Errorf("watch failed: %s", st.Message)
+		}
+	}
+}
+
+// change reports data, stored at resourceVersion, to onChange. Saves are only
+// based on resourceVersion once the data is adopted, so that changes that
+// were ignored are never overwritten.
+func (k *KubernetesSecret) change(resourceVersion string, data []byte, onChange func([]byte) bool) {
+	k.setWatchVersion(resourceVersion)
+	if onChange(data) {
+		k.setResourceVersion(resourceVersion)
+	}
+}
+
+func (k *KubernetesSecret) do(ctx context.Context, method, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := k.authToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return k.client.Do(req)
+}
+
+func (k *KubernetesSecret) secretURL() string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", k.baseURL, url.PathEscape(k.namespace), url.PathEscape(k.name))
+}
+
+func (k *KubernetesSecret) getResourceVersion() string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.resourceVersion
+}
+
+func (k *KubernetesSecret) setResourceVersion(resourceVersion string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.resourceVersion = resourceVersion
+}
+
+func (k *KubernetesSecret) getWatchVersion() string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.watchVersion
+}
+
+func (k *KubernetesSecret) setWatchVersion(watchVersion string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.watchVersion = watchVersion
+}
+
+// readStatus returns an error describing a failed API request.
+func readStatus(res *http.Response) error {
+	var st status
+	if err := json.NewDecoder(res.Body).Decode(&st); err != nil || st.Message == "" {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return fmt.Errorf("unexpected status code: %d (%s): %s", res.StatusCode, st.Reason, st.Message)
+}
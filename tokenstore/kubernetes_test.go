@@ -0,0 +1,372 @@
+package tokenstore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testNamespace = "signer"
+	testSecret    = "signer-token"
+	testKey       = "token.json"
+	testAuthToken = "service-account-token"
+)
+
+// fakeAPIServer serves a single Secret the way the Kubernetes API server does:
+// writes are rejected if they are based on an outdated resourceVersion, and
+// watches stream every change made after the requested resourceVersion.
+type fakeAPIServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu sync.Mutex
+	// resourceVersion is the latest resourceVersion of the namespace, and
+	// secretVersion the one the Secret was last modified at
+	resourceVersion int
+	secretVersion   int
+	data            map[string][]byte
+	events          []fakeEvent
+	changed         chan struct{}
+}
+
+type fakeEvent struct {
+	resourceVersion int
+	body            []byte
+}
+
+func newFakeAPIServer(t *testing.T, data map[string][]byte) *fakeAPIServer {
+	f := &fakeAPIServer{
+		t:               t,
+		resourceVersion: 1,
+		secretVersion:   1,
+		data:            data,
+		changed:         make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/namespaces/"+testNamespace+"/secrets/"+testSecret, f.get)
+	mux.HandleFunc("PATCH /api/v1/namespaces/"+testNamespace+"/secrets/"+testSecret, f.patch)
+	mux.HandleFunc("GET /api/v1/namespaces/"+testNamespace+"/secrets", f.watch)
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAuthToken {
+			writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestKubernetesSecret(server *fakeAPIServer) *KubernetesSecret {
+	authToken := func() (string, error) {
+		return testAuthToken, nil
+	}
+	return newKubernetesSecret(server.URL, server.Client(), authToken, testNamespace, testSecret, testKey, logging.NoLog{})
+}
+
+// secretJSON must be called with mu held.
+func (f *fakeAPIServer) secretJSON() []byte {
+	body, err := json.Marshal(map[string]any{
+		"metadata": map[string]string{
+			"name":            testSecret,
+			"namespace":       testNamespace,
+			"resourceVersion": strconv.Itoa(f.secretVersion),
+		},
+		"data": f.data,
+	})
+	require.NoError(f.t, err)
+	return body
+}
+
+// update sets key to value as another client would.
+func (f *fakeAPIServer) update(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(key, value)
+	f.notify("MODIFIED", f.secretJSON())
+}
+
+// expire sets key to value without sending a watch event for it, as if the
+// event had been compacted away, and ends watches with 410 Gone.
+func (f *fakeAPIServer) expire(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(key, value)
+
+	body, err := json.Marshal(status{Message: "too old resource version", Reason: "Expired", Code: http.StatusGone})
+	require.NoError(f.t, err)
+	f.notify("ERROR", body)
+}
+
+// bookmark sends a bookmark for a change to another object of the namespace,
+// which moves the resourceVersion of the namespace past the Secret's.
+func (f *fakeAPIServer) bookmark() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resourceVersion++
+
+	body, err := json.Marshal(map[string]any{
+		"kind":     "Secret",
+		"metadata": map[string]string{"resourceVersion": strconv.Itoa(f.resourceVersion)},
+	})
+	require.NoError(f.t, err)
+	f.notify("BOOKMARK", body)
+}
+
+// set must be called with mu held.
+func (f *fakeAPIServer) set(key string, value []byte) {
+	f.resourceVersion++
+	f.secretVersion = f.resourceVersion
+	f.data[key] = value
+}
+
+// notify must be called with mu held.
+func (f *fakeAPIServer) notify(eventType string, object []byte) {
+	body, err := json.Marshal(watchEvent{Type: eventType, Object: object})
+	require.NoError(f.t, err)
+	f.events = append(f.events, fakeEvent{resourceVersion: f.resourceVersion, body: body})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeAPIServer) get(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _ = w.Write(f.secretJSON())
+}
+
+func (f *fakeAPIServer) patch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+		writeStatus(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType")
+		return
+	}
+
+	var patch secret
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if patch.Metadata.ResourceVersion != strconv.Itoa(f.secretVersion) {
+		writeStatus(w, http.StatusConflict, "Conflict")
+		return
+	}
+	for key, value := range patch.Data {
+		f.set(key, value)
+	}
+	f.notify("MODIFIED", f.secretJSON())
+	_, _ = w.Write(f.secretJSON())
+}
+
+func (f *fakeAPIServer) watch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("watch") != "true" || query.Get("fieldSelector") != "metadata.name="+testSecret {
+		writeStatus(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+	from, err := strconv.Atoi(query.Get("resourceVersion"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+
+	flusher := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		f.mu.Lock()
+		var pending [][]byte
+		for _, event := range f.events {
+			if event.resourceVersion > from {
+				pending = append(pending, event.body)
+				from = event.resourceVersion
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		for _, body := range pending {
+			_, _ = w.Write(append(body, '\n'))
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status{Message: reason, Reason: reason, Code: code})
+}
+
+func TestKubernetesSecretLoadSave(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{testKey: []byte(`{"token":"first"}`)})
+	store := newTestKubernetesSecret(server)
+	ctx := context.Background()
+
+	require.ErrorIs(store.Save(ctx, []byte(`{"token":"second"}`)), errNotLoaded)
+
+	data, err := store.Load(ctx)
+	require.NoError(err)
+	require.Equal(`{"token":"first"}`, string(data))
+
+	require.NoError(store.Save(ctx, []byte(`{"token":"second"}`)))
+	// saves are based on the resourceVersion of the previous save
+	require.NoError(store.Save(ctx, []byte(`{"token":"third"}`)))
+
+	data, err = newTestKubernetesSecret(server).Load(ctx)
+	require.NoError(err)
+	require.Equal(`{"token":"third"}`, string(data))
+}
+
+func TestKubernetesSecretSaveConflict(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{testKey: []byte(`{"token":"first"}`)})
+	store := newTestKubernetesSecret(server)
+	other := newTestKubernetesSecret(server)
+	ctx := context.Background()
+
+	_, err := store.Load(ctx)
+	require.NoError(err)
+	_, err = other.Load(ctx)
+	require.NoError(err)
+
+	require.NoError(other.Save(ctx, []byte(`{"token":"other"}`)))
+	require.ErrorIs(store.Save(ctx, []byte(`{"token":"stale"}`)), ErrConflict)
+
+	data, err := store.Load(ctx)
+	require.NoError(err)
+	require.Equal(`{"token":"other"}`, string(data))
+	require.NoError(store.Save(ctx, []byte(`{"token":"second"}`)))
+}
+
+func TestKubernetesSecretLoadErrors(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{"other-key": []byte(`{}`)})
+	ctx := context.Background()
+
+	_, err := newTestKubernetesSecret(server).Load(ctx)
+	require.ErrorIs(err, errMissingTokenData)
+
+	unauthorized := newKubernetesSecret(server.URL, server.Client(), func() (string, error) {
+		return "wrong-token", nil
+	}, testNamespace, testSecret, testKey, logging.NoLog{})
+	_, err = unauthorized.Load(ctx)
+	require.ErrorContains(err, "401")
+}
+
+// startWatch watches store until the test ends, adopting changes if adopt is
+// true, and returns a function that waits for the next change.
+func startWatch(t *testing.T, store TokenStore, adopt bool) func() string {
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.Watch(ctx, func(data []byte) bool {
+			changes <- string(data)
+			return adopt
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return func() string {
+		select {
+		case data := <-changes:
+			return data
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for a change")
+			return ""
+		}
+	}
+}
+
+func TestKubernetesSecretWatch(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{testKey: []byte(`{"token":"first"}`)})
+	store := newTestKubernetesSecret(server)
+	_, err := store.Load(context.Background())
+	require.NoError(err)
+	nextChange := startWatch(t, store, true)
+
+	// changes made by others are picked up
+	server.update(testKey, []byte(`{"token":"second"}`))
+	require.Equal(`{"token":"second"}`, nextChange())
+
+	// the watch keeps the resourceVersion used by saves up to date
+	require.NoError(store.Save(context.Background(), []byte(`{"token":"third"}`)))
+	require.Equal(`{"token":"third"}`, nextChange())
+
+	// changes missed while the watch was expired are loaded again
+	server.expire(testKey, []byte(`{"token":"fourth"}`))
+	require.Equal(`{"token":"fourth"}`, nextChange())
+
+	// and the watch resumes from the reloaded resourceVersion
+	server.update(testKey, []byte(`{"token":"fifth"}`))
+	require.Equal(`{"token":"fifth"}`, nextChange())
+}
+
+func TestKubernetesSecretWatchBookmark(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{testKey: []byte(`{"token":"first"}`)})
+	store := newTestKubernetesSecret(server)
+	_, err := store.Load(context.Background())
+	require.NoError(err)
+	nextChange := startWatch(t, store, true)
+
+	server.bookmark()
+	require.Eventually(func() bool {
+		return store.getWatchVersion() == "2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the bookmark's resourceVersion isn't the Secret's, so saves aren't based
+	// on it
+	require.NoError(store.Save(context.Background(), []byte(`{"token":"second"}`)))
+	require.Equal(`{"token":"second"}`, nextChange())
+}
+
+func TestKubernetesSecretWatchNotAdopted(t *testing.T) {
+	require := require.New(t)
+
+	server := newFakeAPIServer(t, map[string][]byte{testKey: []byte(`{"token":"first"}`)})
+	store := newTestKubernetesSecret(server)
+	_, err := store.Load(context.Background())
+	require.NoError(err)
+	nextChange := startWatch(t, store, false)
+
+	// changes that weren't adopted aren't overwritten
+	server.update(testKey, []byte(`{"token":"other"}`))
+	require.Equal(`{"token":"other"}`, nextChange())
+	require.ErrorIs(store.Save(context.Background(), []byte(`{"token":"second"}`)), ErrConflict)
+
+	// even once they were missed and reloaded
+	server.expire(testKey, []byte(`{"token":"expired"}`))
+	require.Equal(`{"token":"expired"}`, nextChange())
+	require.ErrorIs(store.Save(context.Background(), []byte(`{"token":"second"}`)), ErrConflict)
+}
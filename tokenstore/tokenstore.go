@@ -0,0 +1,33 @@
+// Package tokenstore persists the CubeSigner session of a key, in a local
+// file, a Kubernetes Secret or a Vault KV v2 secret. Any of them can be
+// wrapped to encrypt the session at rest.
+package tokenstore
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrConflict is returned by Save when the stored token data was modified
+	// since it was last read.
+	ErrConflict = errors.New("token data was modified concurrently")
+
+	errNotLoaded        = errors.New("token data must be loaded before it is saved")
+	errMissingTokenData = errors.New("no token data found")
+)
+
+// TokenStore stores the JSON token data of a CubeSigner session.
+type TokenStore interface {
+	// Load returns the stored token data.
+	Load(ctx context.Context) ([]byte, error)
+	// Save replaces the stored token data.
+	Save(ctx context.Context, data []byte) error
+	// Watch calls onChange with the stored token data whenever it changes,
+	// until ctx is cancelled. Changes made through Save may or may not be
+	// reported. onChange returns true if the data was adopted, and only then
+	// are later saves based on it.
+	Watch(ctx context.Context, onChange func([]byte) bool) error
+	// String describes where the token data is stored, for logging.
+	String() string
+}
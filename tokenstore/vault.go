@@ -0,0 +1,409 @@
+package tokenstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultVaultKVMount      = "secret"
+	DefaultVaultAppRoleMount = "approle"
+	DefaultVaultPollInterval = 30 * time.Second
+
+	vaultRequestTimeout = 30 * time.Second
+	// vaultCheckAndSetMismatch is the error Vault returns for writes based
+	// on an outdated version
+	vaultCheckAndSetMismatch = "check-and-set parameter did not match the current version"
+	// AppRole tokens are replaced once this fraction of their lease has
+	// elapsed
+	vaultTokenRenewalFraction = 0.8
+)
+
+var (
+	_ TokenStore = (*Vault)(nil)
+
+	errVaultNoAuth        = errors.New("either a Vault token or an AppRole role ID and secret ID are required")
+	errVaultAmbiguousAuth = errors.New("a Vault token and an AppRole cannot be used together")
+)
+
+// VaultConfig configures a Vault KV v2 token store.
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	// Mount path of the KV v2 secrets engine
+	KVMount string
+	// Path of the secret holding the token data, within KVMount
+	Path string
+
+	// Token authenticates with a Vault token. Alternatively, RoleID and
+	// SecretID log in with the AppRole auth method mounted at AppRoleMount.
+	Token        string
+	RoleID       string
+	SecretID     string
+	AppRoleMount string
+
+	// How often the secret is checked for new versions
+	PollInterval time.Duration
+}
+
+// Validate returns an error if the store can't be created from c.
+func (c VaultConfig) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("vault address is required")
+	}
+	if c.KVMount == "" || c.Path == "" {
+		return fmt.Errorf("vault KV mount and path are required")
+	}
+	appRole := c.RoleID != "" || c.SecretID != ""
+	switch {
+	case c.Token != "" && appRole:
+		return errVaultAmbiguousAuth
+	case c.Token == "" && (c.RoleID == "" || c.SecretID == ""):
+		return errVaultNoAuth
+	case appRole && c.AppRoleMount == "":
+		return fmt.Errorf("vault AppRole mount is required")
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("vault poll interval must be positive")
+	}
+	return nil
+}
+
+// Vault stores the token data as a secret of a Vault KV v2 secrets engine.
+// Saves are check-and-set writes against the version of the secret last
+// loaded, saved or adopted, so that a session written by someone else is
+// never silently overwritten. KV secrets can't be watched, so they are polled for new
+// versions instead.
+//
+// The Vault token or AppRole needs the read, create and update capabilities
+// on the secret's data path.
+type Vault struct {
+	config VaultConfig
+	client *http.Client
+	log    logging.Logger
+
+	lock    sync.Mutex
+	version int
+	// token is the Vault token used for requests, either the configured one
+	// or one obtained through AppRole, which is renewed by logging in again
+	// once it is close to expiring.
+	token       string
+	tokenExpiry time.Time
+
+	// serializes AppRole logins, which are made without holding lock
+	loginLock sync.Mutex
+}
+
+func NewVault(config VaultConfig, log logging.Logger) (*Vault, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return newVault(config, &http.Client{Timeout: vaultRequestTimeout}, log), nil
+}
+
+func newVault(config VaultConfig, client *http.Client, log logging.Logger) *Vault {
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	config.KVMount = strings.Trim(config.KVMount, "/")
+	config.Path = strings.Trim(config.Path, "/")
+	config.AppRoleMount = strings.Trim(config.AppRoleMount, "/")
+	return &Vault{
+		config: config,
+		client: client,
+		log:    log,
+		token:  config.Token,
+	}
+}
+
+func (v *Vault) String() string {
+	return fmt.Sprintf("vault %s/%s", v.config.KVMount, v.config.Path)
+}
+
+type vaultSecret struct {
+	Data struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+}
+
+type vaultWriteResponse struct {
+	Data struct {
+		Version int `json:"version"`
+	} `json:"data"`
+}
+
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+type vaultErrors struct {
+	Errors []string `json:"errors"`
+}
+
+func (v *Vault) Load(ctx context.Context) ([]byte, error) {
+	data, version, err := v.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.setVersion(version)
+	return data, nil
+}
+
+func (v *Vault) read(ctx context.Context) ([]byte, int, error) {
+	res, err := v.do(ctx, http.MethodGet, v.dataPath(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// The latest version is also reported as missing once it is deleted
+		return nil, 0, fmt.Errorf("failed to load %s: %w", v, errMissingTokenData)
+	default:
+		return nil, 0, fmt.Errorf("failed to read %s: %w", v, readVaultErrors(res))
+	}
+
+	var secret vaultSecret
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode %s: %w", v, err)
+	}
+	if len(secret.Data.Data) == 0 || string(secret.Data.Data) == "null" {
+		return nil, 0, fmt.Errorf("failed to load %s: %w", v, errMissingTokenData)
+	}
+	return secret.Data.Data, secret.Data.Metadata.Version, nil
+}
+
+// Save writes data as a new version of the secret, if no other version was
+// written since the one last loaded, saved or adopted from Watch. Otherwise
+// ErrConflict is returned.
+func (v *Vault) Save(ctx context.Context, data []byte) error {
+	version := v.getVersion()
+	if version == 0 {
+		return errNotLoaded
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"options": map[string]int{"cas": version},
+		"data":    json.RawMessage(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := v.do(ctx, http.MethodPost, v.dataPath(), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := readVaultErrors(res)
+		if res.StatusCode == http.StatusBadRequest && strings.Contains(err.Error(), vaultCheckAndSetMismatch) {
+			return fmt.Errorf("failed to save %s: %w", v, ErrConflict)
+		}
+		return fmt.Errorf("failed to save %s: %w", v, err)
+	}
+
+	var written vaultWriteResponse
+	if err := json.NewDecoder(res.Body).Decode(&written); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", v, err)
+	}
+	v.setVersion(written.Data.Version)
+	return nil
+}
+
+// Watch polls the secret for versions written by others. Saves are only based
+// on a polled version once it is adopted, so that versions that were ignored
+// are never overwritten.
+func (v *Vault) Watch(ctx context.Context, onChange func([]byte) bool) error {
+	ticker := time.NewTicker(v.config.PollInterval)
+	defer ticker.Stop()
+
+	// the latest version reported to onChange
+	var polled int
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		data, version, err := v.read(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				v.log.Warn("Failed to poll Vault for token data", zap.Stringer("store", v), zap.Error(err))
+			}
+			continue
+		}
+
+		if version <= max(polled, v.getVersion()) {
+			continue
+		}
+		polled = version
+
+		if onChange(data) {
+			v.lock.Lock()
+			v.version = max(v.version, version)
+			v.lock.Unlock()
+		}
+	}
+}
+
+// do sends a request to Vault. If an AppRole token is rejected, e.g. because
+// it was revoked, it logs in again and retries once.
+func (v *Vault) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	res, err := v.send(ctx, method, path, body)
+	if err != nil || res.StatusCode != http.StatusForbidden || v.config.Token != "" {
+		return res, err
+	}
+	_ = res.Body.Close()
+
+	v.lock.Lock()
+	v.token = ""
+	v.lock.Unlock()
+	return v.send(ctx, method, path, body)
+}
+
+func (v *Vault) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.config.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return v.client.Do(req)
+}
+
+// authToken returns the Vault token to use, logging in with AppRole if there
+// is no token yet or it is about to expire. Concurrent callers wait for a
+// single login.
+func (v *Vault) authToken(ctx context.Context) (string, error) {
+	if token, ok := v.currentToken(); ok {
+		return token, nil
+	}
+
+	v.loginLock.Lock()
+	defer v.loginLock.Unlock()
+
+	// Another caller may have logged in while this one was waiting
+	if token, ok := v.currentToken(); ok {
+		return token, nil
+	}
+
+	login, err := v.login(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var tokenExpiry time.Time
+	if login.Auth.LeaseDuration > 0 {
+		lease := time.Duration(login.Auth.LeaseDuration) * time.Second
+		tokenExpiry = time.Now().Add(time.Duration(vaultTokenRenewalFraction * float64(lease)))
+	}
+
+	v.lock.Lock()
+	v.token = login.Auth.ClientToken
+	v.tokenExpiry = tokenExpiry
+	v.lock.Unlock()
+
+	v.log.Debug("Logged in to Vault with AppRole",
+		zap.Stringer("store", v),
+		zap.Int("leaseDuration", login.Auth.LeaseDuration),
+	)
+	return login.Auth.ClientToken, nil
+}
+
+// currentToken returns the Vault token, if there is one that isn't about to
+// expire.
+func (v *Vault) currentToken() (string, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.token, v.token != "" && (v.tokenExpiry.IsZero() || time.Now().Before(v.tokenExpiry))
+}
+
+// login logs in with the AppRole auth method.
+func (v *Vault) login(ctx context.Context) (*vaultLoginResponse, error) {
+	body, err := json.Marshal(map[string]string{
+		"role_id":   v.config.RoleID,
+		"secret_id": v.config.SecretID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loginURL := fmt.Sprintf("%s/v1/auth/%s/login", v.config.Address, v.config.AppRoleMount)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to Vault: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to log in to Vault: %w", readVaultErrors(res))
+	}
+
+	var login vaultLoginResponse
+	if err := json.NewDecoder(res.Body).Decode(&login); err != nil {
+		return nil, fmt.Errorf("failed to decode Vault login: %w", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("failed to log in to Vault: no client token returned")
+	}
+	return &login, nil
+}
+
+func (v *Vault) dataPath() string {
+	return fmt.Sprintf("/v1/%s/data/%s", v.config.KVMount, v.config.Path)
+}
+
+func (v *Vault) getVersion() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.version
+}
+
+func (v *Vault) setVersion(version int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.version = version
+}
+
+// readVaultErrors returns an error describing a failed Vault request.
+func readVaultErrors(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body)
+	var errs vaultErrors
+	if err := json.Unmarshal(body, &errs); err != nil || len(errs.Errors) == 0 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return fmt.Errorf("unexpected status code: %d: %s", res.StatusCode, strings.Join(errs.Errors, "; "))
+}
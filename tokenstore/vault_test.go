@@ -0,0 +1,388 @@
+package tokenstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testVaultPath     = "cube-signer/validator"
+	testVaultToken    = "vault-token"
+	testVaultRoleID   = "role-id"
+	testVaultSecretID = "secret-id"
+)
+
+// fakeVault serves a single KV v2 secret and AppRole logins the way Vault
+// does: writes must pass the current version as the check-and-set
+// parameter, and requests must carry a valid token.
+type fakeVault struct {
+	*httptest.Server
+	t *testing.T
+
+	mu       sync.Mutex
+	versions []json.RawMessage
+	tokens   map[string]bool
+	logins   int
+	// if set, logins are held until it is closed
+	loginGate chan struct{}
+}
+
+func newFakeVault(t *testing.T, data string) *fakeVault {
+	f := &fakeVault{
+		t:      t,
+		tokens: map[string]bool{testVaultToken: true},
+	}
+	if data != "" {
+		f.versions = append(f.versions, json.RawMessage(data))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/auth/approle/login", f.login)
+	mux.HandleFunc("GET /v1/secret/data/"+testVaultPath, f.authenticated(f.read))
+	mux.HandleFunc("POST /v1/secret/data/"+testVaultPath, f.authenticated(f.write))
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeVault) config() VaultConfig {
+	return VaultConfig{
+		Address:      f.URL,
+		KVMount:      DefaultVaultKVMount,
+		Path:         testVaultPath,
+		Token:        testVaultToken,
+		PollInterval: 10 * time.Millisecond,
+	}
+}
+
+func (f *fakeVault) newStore(config VaultConfig) *Vault {
+	require.NoError(f.t, config.Validate())
+	return newVault(config, f.Client(), logging.NoLog{})
+}
+
+// update writes a new version of the secret as another client would.
+func (f *fakeVault) update(data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions = append(f.versions, json.RawMessage(data))
+}
+
+// revoke invalidates every token issued through AppRole.
+func (f *fakeVault) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = map[string]bool{testVaultToken: true}
+}
+
+func (f *fakeVault) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins
+}
+
+func (f *fakeVault) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		valid := f.tokens[r.Header.Get("X-Vault-Token")]
+		f.mu.Unlock()
+		if !valid {
+			writeVaultErrors(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (f *fakeVault) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.RoleID != testVaultRoleID || req.SecretID != testVaultSecretID {
+		writeVaultErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+
+	f.mu.Lock()
+	f.logins++
+	token := fmt.Sprintf("approle-token-%d", f.logins)
+	f.tokens[token] = true
+	gate := f.loginGate
+	f.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"auth": map[string]any{"client_token": token, "lease_duration": 3600},
+	})
+}
+
+func (f *fakeVault) read(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.versions) == 0 {
+		writeVaultErrors(w, http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"data": map[string]any{
+			"data":     f.versions[len(f.versions)-1],
+			"metadata": map[string]int{"version": len(f.versions)},
+		},
+	})
+}
+
+func (f *fakeVault) write(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Options struct {
+			CAS *int `json:"cas"`
+		} `json:"options"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeVaultErrors(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Options.CAS != nil && *req.Options.CAS != len(f.versions) {
+		writeVaultErrors(w, http.StatusBadRequest, "check-and-set parameter did not match the current version")
+		return
+	}
+	f.versions = append(f.versions, req.Data)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"data": map[string]int{"version": len(f.versions)},
+	})
+}
+
+func writeVaultErrors(w http.ResponseWriter, code int, errs ...string) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(vaultErrors{Errors: errs})
+}
+
+func TestVaultLoadSave(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	store := vault.newStore(vault.config())
+	ctx := context.Background()
+
+	require.ErrorIs(store.Save(ctx, []byte(`{"token":"second"}`)), errNotLoaded)
+
+	data, err := store.Load(ctx)
+	require.NoError(err)
+	require.JSONEq(`{"token":"first"}`, string(data))
+
+	require.NoError(store.Save(ctx, []byte(`{"token":"second"}`)))
+	// saves are based on the version of the previous save
+	require.NoError(store.Save(ctx, []byte(`{"token":"third"}`)))
+
+	data, err = vault.newStore(vault.config()).Load(ctx)
+	require.NoError(err)
+	require.JSONEq(`{"token":"third"}`, string(data))
+}
+
+func TestVaultSaveConflict(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	store := vault.newStore(vault.config())
+	ctx := context.Background()
+
+	_, err := store.Load(ctx)
+	require.NoError(err)
+
+	vault.update(`{"token":"other"}`)
+	require.ErrorIs(store.Save(ctx, []byte(`{"token":"stale"}`)), ErrConflict)
+
+	data, err := store.Load(ctx)
+	require.NoError(err)
+	require.JSONEq(`{"token":"other"}`, string(data))
+	require.NoError(store.Save(ctx, []byte(`{"token":"second"}`)))
+}
+
+func TestVaultLoadErrors(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, "")
+	ctx := context.Background()
+
+	_, err := vault.newStore(vault.config()).Load(ctx)
+	require.ErrorIs(err, errMissingTokenData)
+
+	config := vault.config()
+	config.Token = "wrong-token"
+	_, err = vault.newStore(config).Load(ctx)
+	require.ErrorContains(err, "permission denied")
+}
+
+func TestVaultAppRole(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	config := vault.config()
+	config.Token = ""
+	config.RoleID = testVaultRoleID
+	config.SecretID = testVaultSecretID
+	config.AppRoleMount = DefaultVaultAppRoleMount
+	store := vault.newStore(config)
+	ctx := context.Background()
+
+	_, err := store.Load(ctx)
+	require.NoError(err)
+	require.NoError(store.Save(ctx, []byte(`{"token":"second"}`)))
+	require.Equal(1, vault.loginCount())
+
+	// a revoked token is replaced by logging in again
+	vault.revoke()
+	require.NoError(store.Save(ctx, []byte(`{"token":"third"}`)))
+	require.Equal(2, vault.loginCount())
+
+	config.SecretID = "wrong-secret-id"
+	_, err = vault.newStore(config).Load(ctx)
+	require.ErrorContains(err, "failed to log in to Vault")
+}
+
+func TestVaultAppRoleConcurrentLogin(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	gate := make(chan struct{})
+	vault.loginGate = gate
+	config := vault.config()
+	config.Token = ""
+	config.RoleID = testVaultRoleID
+	config.SecretID = testVaultSecretID
+	config.AppRoleMount = DefaultVaultAppRoleMount
+	store := vault.newStore(config)
+
+	loaded := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := store.Load(context.Background())
+			loaded <- err
+		}()
+	}
+	require.Eventually(func() bool {
+		return vault.loginCount() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the store isn't locked while logging in
+	versionRead := make(chan int)
+	go func() {
+		versionRead <- store.getVersion()
+	}()
+	select {
+	case <-versionRead:
+	case <-time.After(5 * time.Second):
+		require.FailNow("store locked while logging in")
+	}
+
+	// and both loads use the same login
+	close(gate)
+	require.NoError(<-loaded)
+	require.NoError(<-loaded)
+	require.Equal(1, vault.loginCount())
+}
+
+func TestVaultWatch(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	store := vault.newStore(vault.config())
+	_, err := store.Load(context.Background())
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.Watch(ctx, func(data []byte) bool {
+			changes <- string(data)
+			return true
+		})
+	}()
+
+	// versions written by others are picked up
+	vault.update(`{"token":"second"}`)
+	select {
+	case data := <-changes:
+		require.JSONEq(`{"token":"second"}`, string(data))
+	case <-time.After(5 * time.Second):
+		require.FailNow("timed out waiting for a change")
+	}
+
+	// and the version used by saves is kept up to date
+	require.NoError(store.Save(context.Background(), []byte(`{"token":"third"}`)))
+
+	cancel()
+	require.NoError(<-done)
+}
+
+func TestVaultWatchNotAdopted(t *testing.T) {
+	require := require.New(t)
+
+	vault := newFakeVault(t, `{"token":"first"}`)
+	store := vault.newStore(vault.config())
+	_, err := store.Load(context.Background())
+	require.NoError(err)
+	nextChange := startWatch(t, store, false)
+
+	// versions that weren't adopted are reported once, and aren't overwritten
+	vault.update(`{"token":"other"}`)
+	require.JSONEq(`{"token":"other"}`, nextChange())
+	require.ErrorIs(store.Save(context.Background(), []byte(`{"token":"second"}`)), ErrConflict)
+
+	vault.update(`{"token":"newer"}`)
+	require.JSONEq(`{"token":"newer"}`, nextChange())
+}
+
+func TestVaultConfigValidate(t *testing.T) {
+	require := require.New(t)
+
+	valid := VaultConfig{
+		Address:      "https://vault.example.com",
+		KVMount:      DefaultVaultKVMount,
+		Path:         testVaultPath,
+		Token:        testVaultToken,
+		PollInterval: DefaultVaultPollInterval,
+	}
+	require.NoError(valid.Validate())
+
+	appRole := valid
+	appRole.Token = ""
+	appRole.RoleID = testVaultRoleID
+	appRole.SecretID = testVaultSecretID
+	appRole.AppRoleMount = DefaultVaultAppRoleMount
+	require.NoError(appRole.Validate())
+
+	noAuth := valid
+	noAuth.Token = ""
+	require.ErrorIs(noAuth.Validate(), errVaultNoAuth)
+
+	noSecretID := appRole
+	noSecretID.SecretID = ""
+	require.ErrorIs(noSecretID.Validate(), errVaultNoAuth)
+
+	both := appRole
+	both.Token = testVaultToken
+	require.ErrorIs(both.Validate(), errVaultAmbiguousAuth)
+
+	noPath := valid
+	noPath.Path = ""
+	require.Error(noPath.Validate())
+}
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// RequestIDKey is the span attribute holding the request ID returned by
+// CubeSigner in error responses.
+const RequestIDKey = attribute.Key("cubesigner.request_id")
+
+// ServerOption returns a gRPC server option that opens a span for every
+// incoming RPC, except for health checks.
+func ServerOption(tp trace.TracerProvider) grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler(
+		otelgrpc.WithTracerProvider(tp),
+		otelgrpc.WithFilter(filters.Not(filters.HealthCheck())),
+	))
+}
+
+// NewHTTPClient returns an HTTP client that records a span for every request,
+// continuing the trace found in the request context. DNS, connect, TLS and
+// first byte timings are recorded as events on the span, as well as the
+// CubeSigner request ID of error responses.
+func NewHTTPClient(tp trace.TracerProvider, base http.RoundTripper) *http.Client {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &http.Client{
+		Transport: otelhttp.NewTransport(
+			&requestIDTransport{base: base},
+			otelhttp.WithTracerProvider(tp),
+			otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+				return otelhttptrace.NewClientTrace(ctx,
+					otelhttptrace.WithTracerProvider(tp),
+					otelhttptrace.WithoutSubSpans(),
+					otelhttptrace.WithoutHeaders(),
+				)
+			}),
+		),
+	}
+}
+
+// requestIDTransport records the request ID of CubeSigner error responses on
+// the span of the request.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.StatusCode < http.StatusBadRequest {
+		return res, err
+	}
+
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() || !strings.Contains(res.Header.Get("Content-Type"), "json") {
+		return res, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	var errorResponse struct {
+		RequestID *string `json:"request_id"`
+	}
+	if err := json.Unmarshal(body, &errorResponse); err == nil && errorResponse.RequestID != nil {
+		span.SetAttributes(RequestIDKey.String(*errorResponse.RequestID))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,86 @@
+// Package tracing configures OpenTelemetry tracing for the signer gRPC server
+// and the CubeSigner API client.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	ExporterNone     = "none"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+
+	serviceName = "cube-signer-sidecar"
+)
+
+type Config struct {
+	// Exporter is one of ExporterNone, ExporterOTLPGRPC or ExporterOTLPHTTP
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector. If empty, the
+	// exporter's default endpoint is used.
+	Endpoint string
+	// Insecure disables TLS when connecting to the collector
+	Insecure bool
+	// SampleRate is the fraction of traces that are sampled
+	SampleRate float64
+}
+
+// New creates a TracerProvider exporting spans as specified by cfg. The
+// returned shutdown function flushes any buffered spans.
+func New(ctx context.Context, cfg Config) (trace.TracerProvider, func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case ExporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case ExporterOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create %s exporter: %w", cfg.Exporter, err)
+	}
+
+	tp := NewTracerProvider(cfg.SampleRate, sdktrace.WithBatcher(exporter))
+	return tp, tp.Shutdown, nil
+}
+
+// NewTracerProvider creates a TracerProvider sampling the given fraction of
+// traces. Additional options, e.g. the span processor, are applied on top.
+func NewTracerProvider(sampleRate float64, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
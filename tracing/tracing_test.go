@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/proto/pb/signer"
+	"github.com/ava-labs/cube-signer-sidecar/api"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const testRequestID = "test-request-id"
+
+// publicKeyServer fetches the key from CubeSigner on every PublicKey request
+type publicKeyServer struct {
+	signer.UnimplementedSignerServer
+	client *api.ClientWithResponses
+}
+
+func (s *publicKeyServer) PublicKey(ctx context.Context, _ *signer.PublicKeyRequest) (*signer.PublicKeyResponse, error) {
+	res, err := s.client.GetKeyInOrgWithResponse(ctx, "test-org", "test-key")
+	if err != nil {
+		return nil, err
+	}
+	return &signer.PublicKeyResponse{PublicKey: res.Body}, nil
+}
+
+func TestTraceFromRPCToCubeSigner(t *testing.T) {
+	require := require.New(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := NewTracerProvider(1, sdktrace.WithSyncer(exporter))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error_code":"SessionExpired","message":"expired","request_id":"` + testRequestID + `"}`))
+	}))
+	defer upstream.Close()
+
+	client, err := api.NewClientWithResponses(upstream.URL, api.WithHTTPClient(NewHTTPClient(tp, nil)))
+	require.NoError(err)
+
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(ServerOption(tp))
+	signer.RegisterSignerServer(grpcServer, &publicKeyServer{client: client})
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(err)
+	defer conn.Close()
+
+	_, err = signer.NewSignerClient(conn).PublicKey(context.Background(), &signer.PublicKeyRequest{})
+	require.NoError(err)
+
+	spans := exporter.GetSpans()
+
+	var rpcSpan, httpSpan *tracetest.SpanStub
+	for i := range spans {
+		switch spans[i].SpanKind {
+		case oteltrace.SpanKindServer:
+			rpcSpan = &spans[i]
+		case oteltrace.SpanKindClient:
+			httpSpan = &spans[i]
+		}
+	}
+	require.NotNil(rpcSpan)
+	require.NotNil(httpSpan)
+	require.Equal("signer.Signer/PublicKey", rpcSpan.Name)
+
+	// the HTTP span continues the RPC trace
+	require.Equal(rpcSpan.SpanContext.TraceID(), httpSpan.SpanContext.TraceID())
+	require.Equal(rpcSpan.SpanContext.SpanID(), httpSpan.Parent.SpanID())
+	require.Contains(httpSpan.Attributes, RequestIDKey.String(testRequestID))
+
+	// connection timings are recorded as events on the HTTP span
+	events := make(map[string]bool)
+	for _, event := range httpSpan.Events {
+		events[event.Name] = true
+	}
+	require.Contains(events, "http.getconn.start")
+	require.Contains(events, "http.receive.start")
+}
+
+func TestNewWithoutExporter(t *testing.T) {
+	require := require.New(t)
+
+	tp, shutdown, err := New(context.Background(), Config{Exporter: ExporterNone})
+	require.NoError(err)
+	require.NotNil(tp)
+	require.NoError(shutdown(context.Background()))
+
+	_, _, err = New(context.Background(), Config{Exporter: "zipkin"})
+	require.Error(err)
+}